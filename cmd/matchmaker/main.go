@@ -0,0 +1,32 @@
+// Command matchmaker runs a standalone matchmaker for Retromancer lobbies.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ketMix/retromancer/net"
+)
+
+func main() {
+	var address string
+	var server net.MatchmakerServer
+
+	flag.StringVar(&address, "address", ":20220", "address to listen on")
+	flag.DurationVar(&server.Expire, "expire", 30*time.Second, "how long a lobby lives without being refreshed by its host")
+	flag.IntVar(&net.MatchmakerMaxListed, "max-listed", net.MatchmakerMaxListed, "maximum amount of lobbies to send in a lobby listing")
+	flag.Parse()
+
+	if err := server.Open(address); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("matchmaker listening on", server.LocalAddr())
+
+	if err := server.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
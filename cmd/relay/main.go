@@ -0,0 +1,51 @@
+//go:build !js
+
+// Command relay runs a standalone relay for players that cannot reach each other.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ketMix/retromancer/net"
+)
+
+func main() {
+	var address, wsAddress, web string
+	var server net.RelayServer
+
+	flag.StringVar(&address, "address", ":20222", "address to listen on")
+	flag.StringVar(&wsAddress, "websocket", "", "address to accept WebSockets on, such as from browsers, or empty to only use UDP")
+	flag.StringVar(&web, "web", "", "directory of the web build to serve alongside the WebSocket")
+	flag.DurationVar(&server.Expire, "expire", 30*time.Second, "how long a session lives without any traffic")
+	flag.IntVar(&server.MaxSessions, "max-sessions", 32, "maximum amount of sessions to relay at once")
+	flag.IntVar(&net.RelayMaxMembers, "max-members", net.RelayMaxMembers, "maximum amount of members in a session, counting its host")
+	flag.DurationVar(&server.StatsInterval, "stats", time.Minute, "how often to log the stats of every session, or 0 to only log them when a session expires")
+	flag.Parse()
+
+	if err := server.Open(address); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("relay listening on", server.LocalAddr())
+
+	if wsAddress != "" {
+		var static http.Handler
+		if web != "" {
+			static = http.FileServer(http.Dir(web))
+		}
+		if err := server.ListenWebSocket(wsAddress, static); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("relay accepting WebSockets on", wsAddress+net.WebSocketPath)
+	}
+
+	if err := server.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -9,6 +9,7 @@ type Flags struct {
 	Fullscreen      bool
 	SkipIntro       bool
 	Map             string
+	Replay          string
 	NetBufferSize   int
 	NetDataShards   int
 	NetParityShards int
@@ -7,7 +7,10 @@ require (
 	github.com/kettek/go-multipath/v2 v2.0.0-alpha.11
 	github.com/tinne26/etxt v0.0.9-alpha.5
 	github.com/xtaci/kcp-go v5.4.20+incompatible
+	golang.design/x/clipboard v0.7.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/image v0.6.0
+	golang.org/x/net v0.6.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -25,11 +28,8 @@ require (
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
-	golang.design/x/clipboard v0.7.0 // indirect
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56 // indirect
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c // indirect
-	golang.org/x/net v0.6.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
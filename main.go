@@ -36,10 +36,23 @@ func main() {
 	flag.StringVar(&game.Flags.Locale, "locale", "en", "locale to use")
 	flag.StringVar(&game.Flags.Font, "font", "x12y16pxMaruMonica", "font to use")
 	flag.StringVar(&game.Flags.Map, "map", "", "map to load")
+	flag.StringVar(&game.Flags.Replay, "replay", "", "replay to play back")
+	flag.StringVar(&gaem.RecordReplay, "record", gaem.RecordReplay, "file to record a replay of each game to")
 	flag.IntVar(&net.NetBufferSize, "net-buffer-size", 1024, "network buffer size")
 	flag.IntVar(&net.NetDataShards, "net-data-shards", 5, "network data shards")
 	flag.IntVar(&net.NetParityShards, "net-parity-shards", 2, "network parity shards")
 	flag.IntVar(&net.NetChannelSize, "net-channel-size", 30, "network channel size")
+	flag.DurationVar(&net.NetHeartbeatInterval, "net-heartbeat", net.NetHeartbeatInterval, "network heartbeat interval")
+	flag.DurationVar(&net.NetTimeout, "net-timeout", net.NetTimeout, "how long a network peer can be silent before timing out")
+	flag.StringVar(&net.NetMatchmakerAddress, "net-matchmaker", net.NetMatchmakerAddress, "network matchmaker address")
+	flag.StringVar(&net.NetRelayAddress, "net-relay", net.NetRelayAddress, "network relay address, used when the other side cannot be reached directly")
+	flag.IntVar(&net.NetDiscoveryPort, "net-discovery-port", net.NetDiscoveryPort, "port LAN games are advertised on")
+	flag.IntVar(&gaem.NetInputDelay, "net-input-delay", gaem.NetInputDelay, "ticks to delay inputs by in networked play, decided by the host")
+	flag.IntVar(&gaem.NetRollback, "net-rollback", gaem.NetRollback, "ticks remote players may be predicted ahead by, 0 disables rollback")
+	flag.BoolVar(&gaem.NetShowStats, "net-stats", gaem.NetShowStats, "whether to show network stats in networked play, toggled with F3")
+	flag.StringVar(&menu.StartingMap, "lobby-map", menu.StartingMap, "map games started from the lobby begin on")
+	flag.Int64Var(&menu.Seed, "seed", menu.Seed, "seed for games started from the lobby, 0 picks one at random")
+	flag.IntVar(&menu.LobbyCountdown, "net-countdown", menu.LobbyCountdown, "seconds to count down from once everyone in a networked game is ready")
 	flag.StringVar(&game.Flags.Difficulty, "difficulty", string(states.DifficultyNormal), "difficulty to play at")
 	flag.Parse()
 
@@ -62,6 +75,13 @@ func main() {
 		panic(err)
 	}
 
+	// Fingerprint our assets so we only play with others that have the same ones.
+	if fingerprint, err := game.Resources.Fingerprint(); err != nil {
+		panic(err)
+	} else {
+		net.NetFingerprint = fingerprint
+	}
+
 	// Load up our gamepad maps.
 	if b, err := game.Resources.files.ReadFile("gamepad.yaml"); err != nil {
 		panic(err)
@@ -117,8 +137,21 @@ func main() {
 	// Set up menu.
 	game.PushState(&menu.Menu{})
 
-	// Quick skip for map testing.
-	if game.Flags.Map != "" {
+	// Play back a replay, or quick skip for map testing.
+	if game.Flags.Replay != "" {
+		f, err := os.Open(game.Flags.Replay)
+		if err != nil {
+			panic(err)
+		}
+		replay, err := gaem.ReadReplay(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		game.PushState(&gaem.World{
+			Replay: replay,
+		})
+	} else if game.Flags.Map != "" {
 		var difficulty states.Difficulty
 		if game.Flags.Difficulty == "hard" {
 			difficulty = states.DifficultyHard
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"image/color"
 	"io/fs"
 	"path/filepath"
@@ -287,6 +288,42 @@ func (m *ResourceManager) LoadDir(category, path string) error {
 	return nil
 }
 
+// Fingerprint hashes the assets that drive the simulation, overrides included.
+func (m *ResourceManager) Fingerprint() (uint64, error) {
+	h := fnv.New64a()
+	for _, category := range []string{"maps", "bullets", "enemies"} {
+		// The same file may be walked once per filesystem, so gather the unique names first.
+		names := make(map[string]struct{})
+		err := m.files.Walk(category+"/", func(path string, entry fs.DirEntry, err error) error {
+			if entry == nil {
+				return ErrMissingDirectory
+			}
+			if !entry.IsDir() {
+				names[entry.Name()] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+
+		for _, name := range sorted {
+			b, err := m.files.ReadFile(fmt.Sprintf("%s/%s", category, name))
+			if err != nil {
+				return 0, err
+			}
+			h.Write([]byte(fmt.Sprintf("%s/%s:%d:", category, name, len(b))))
+			h.Write(b)
+		}
+	}
+	return h.Sum64(), nil
+}
+
 func (m *ResourceManager) LoadAll() error {
 	if err := m.LoadDir("images", "images/"); err != nil {
 		return err
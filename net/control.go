@@ -0,0 +1,56 @@
+package net
+
+import (
+	"bytes"
+	"net"
+)
+
+// Control packets are raw datagrams sent outside of any KCP session, marked by controlMagic.
+var controlMagic = []byte{0xff, 'R', 'E', 'T', 'R', 'O', 0xff}
+
+const (
+	controlPunch uint8 = iota + 1
+	controlPunchAck
+	controlReconnect
+	controlReconnectAck
+	controlReject
+	controlAdvert
+	controlRelayJoin
+	controlRelayJoined
+	controlRelayError
+	controlPing
+	controlPong
+)
+
+func isControlPacket(b []byte) bool {
+	return len(b) > len(controlMagic) && bytes.Equal(b[:len(controlMagic)], controlMagic)
+}
+
+func (s *ServerClient) sendControl(kind uint8, addr net.Addr, payload ...byte) error {
+	b := make([]byte, 0, len(controlMagic)+1+len(payload))
+	b = append(b, controlMagic...)
+	b = append(b, kind)
+	b = append(b, payload...)
+	_, err := s.localConn.WriteTo(b, addr)
+	return err
+}
+
+func (s *ServerClient) handleControlPacket(packet Packet) {
+	b := packet.buffer[len(controlMagic):packet.readBytes]
+	switch b[0] {
+	case controlPunch, controlPunchAck:
+		s.handlePunch(b[0], packet.addr)
+	case controlReconnect, controlReconnectAck:
+		s.handleReconnect(b[0], b[1:], packet.addr)
+	case controlReject:
+		s.handleReject(b[1:], packet.addr)
+	case controlRelayJoined, controlRelayError:
+		s.handleRelayPacket(b[0], b[1:], packet.addr)
+	case controlPing, controlPong:
+		s.handlePing(b[0], b[1:], packet.addr)
+	case controlAdvert:
+		// Adverts are meant for LANBrowsers, but a host on the same port may hear its own.
+	default:
+		logPacket("unknown control packet %d from %s", b[0], packet.addr)
+	}
+}
@@ -0,0 +1,109 @@
+package net
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+
+	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Sessions are always encrypted, with an empty passphrase if none is given.
+const (
+	passphraseSalt       = "retromancer"
+	passphraseIterations = 4096
+	passphraseKeySize    = 32
+	// These mirror the header kcp puts before encrypted packets.
+	cryptNonceSize  = 16
+	cryptHeaderSize = cryptNonceSize + 4
+	// Control packets that act on a peer are signed.
+	controlMACSize = 16
+)
+
+// setPassphrase derives our session key from the given passphrase.
+func (s *ServerClient) setPassphrase(passphrase string) {
+	s.key = pbkdf2.Key([]byte(passphrase), []byte(passphraseSalt), passphraseIterations, passphraseKeySize, sha1.New)
+	s.check = s.newCrypt()
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("control"))
+	s.controlKey = mac.Sum(nil)
+}
+
+// newCrypt returns a BlockCrypt for a new session, as they can't be shared.
+func (s *ServerClient) newCrypt() kcp.BlockCrypt {
+	crypt, err := kcp.NewAESBlockCrypt(s.key)
+	if err != nil {
+		panic(err)
+	}
+	return crypt
+}
+
+// validPacket returns whether the given datagram was encrypted with our key.
+func (s *ServerClient) validPacket(b []byte) bool {
+	if len(b) < cryptHeaderSize {
+		return false
+	}
+	buf := make([]byte, len(b))
+	s.check.Decrypt(buf, b)
+	return crc32.ChecksumIEEE(buf[cryptHeaderSize:]) == binary.LittleEndian.Uint32(buf[cryptNonceSize:])
+}
+
+// controlMAC returns the signature of a control packet.
+func (s *ServerClient) controlMAC(kind uint8, payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.controlKey)
+	mac.Write([]byte{kind})
+	mac.Write(payload)
+	return mac.Sum(nil)[:controlMACSize]
+}
+
+// sendSignedControl sends a control packet followed by its signature.
+func (s *ServerClient) sendSignedControl(kind uint8, addr net.Addr, payload ...byte) error {
+	return s.sendControl(kind, addr, append(payload, s.controlMAC(kind, payload)...)...)
+}
+
+// checkControl returns the payload of a signed control packet, and whether its signature is ours.
+func (s *ServerClient) checkControl(kind uint8, b []byte) ([]byte, bool) {
+	if len(b) < controlMACSize {
+		return nil, false
+	}
+	payload := b[:len(b)-controlMACSize]
+	return payload, hmac.Equal(b[len(payload):], s.controlMAC(kind, payload))
+}
+
+// rejectPassphrase tells the sender of a packet we could not decrypt that our passphrases differ.
+func (s *ServerClient) rejectPassphrase(addr net.Addr) {
+	logPacket("rejecting %s: %s", addr, RejectReasonPassphrase)
+	if err := s.sendSignedControl(controlReject, addr, AppendString(nil, RejectReasonPassphrase)...); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// handleReject handles a rejection sent outside of a session. Unsigned ones are only taken from unverified peers.
+func (s *ServerClient) handleReject(b []byte, addr net.Addr) {
+	payload, signed := s.checkControl(controlReject, b)
+	reason, n := ReadString(payload)
+	if n < 0 {
+		return
+	}
+	for _, p := range s.Peers() {
+		if p.addr.String() == addr.String() {
+			if !signed && p.verified {
+				logPacket("dropping unsigned reject from %s", addr)
+				return
+			}
+			if !p.rejected.Swap(true) {
+				s.EventChan <- EventRejected{
+					Peer:   p,
+					ID:     p.id,
+					Reason: reason,
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NetDiscoveryPort is the port hosts advertise their lobbies to on the LAN.
+var NetDiscoveryPort = 20221
+
+// NetDiscoveryInterval is how often a host advertises its lobby on the LAN.
+var NetDiscoveryInterval = 1 * time.Second
+
+// NetDiscoveryExpire is how long a host stays listed after its last advert.
+var NetDiscoveryExpire = 5 * time.Second
+
+// advertInfo holds what Advertise was last given.
+type advertInfo struct {
+	info []byte
+}
+
+// Advertise sets the info broadcast to the LAN while hosting. Passing nil stops advertising.
+func (s *ServerClient) Advertise(info []byte) {
+	if info == nil {
+		s.advert.Store((*advertInfo)(nil))
+		return
+	}
+	s.advert.Store(&advertInfo{info: append([]byte(nil), info...)})
+}
+
+// advertise broadcasts our lobby to the LAN from our own connection.
+func (s *ServerClient) advertise() {
+	if !s.Hosting || !s.Transport.Direct() {
+		return
+	}
+	advert, _ := s.advert.Load().(*advertInfo)
+	if advert == nil {
+		return
+	}
+	var payload []byte
+	payload = binary.LittleEndian.AppendUint16(payload, NetProtocolVersion)
+	payload = binary.LittleEndian.AppendUint64(payload, NetFingerprint)
+	payload = append(payload, advert.info...)
+	for _, addr := range broadcastAddrs() {
+		if err := s.sendControl(controlAdvert, addr, payload...); err != nil {
+			fmt.Println("failed to advertise to", addr, err)
+		}
+	}
+}
+
+// broadcastAddrs returns the broadcast address of every LAN we are on.
+func broadcastAddrs() (addrs []*net.UDPAddr) {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifaddr := range ifaddrs {
+			ipnet, ok := ifaddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			if ip == nil || len(ipnet.Mask) != net.IPv4len {
+				continue
+			}
+			broadcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				broadcast[i] = ip[i] | ^ipnet.Mask[i]
+			}
+			addrs = append(addrs, &net.UDPAddr{IP: broadcast, Port: NetDiscoveryPort})
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, &net.UDPAddr{IP: net.IPv4bcast, Port: NetDiscoveryPort})
+	}
+	return
+}
+
+// LANHost is a host found advertising its lobby on the LAN.
+type LANHost struct {
+	Address string // Address to join the host at.
+	Info    []byte // Whatever the host passed to Advertise.
+	seen    time.Time
+}
+
+// LANBrowser listens for hosts advertising their lobbies on the LAN.
+type LANBrowser struct {
+	conn  *net.UDPConn
+	lock  sync.Mutex
+	hosts map[string]LANHost
+	open  atomic.Bool
+}
+
+// Open starts listening for adverts on NetDiscoveryPort.
+func (b *LANBrowser) Open() error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: NetDiscoveryPort})
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.hosts = make(map[string]LANHost)
+	b.open.Store(true)
+	go b.loop()
+	return nil
+}
+
+// Close stops listening for adverts.
+func (b *LANBrowser) Close() error {
+	if !b.open.Swap(false) {
+		return nil
+	}
+	return b.conn.Close()
+}
+
+// Running returns whether the browser is listening.
+func (b *LANBrowser) Running() bool {
+	return b.open.Load()
+}
+
+// Hosts returns the hosts heard from recently, ordered by address.
+func (b *LANBrowser) Hosts() (hosts []LANHost) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for address, host := range b.hosts {
+		if time.Since(host.seen) > NetDiscoveryExpire {
+			delete(b.hosts, address)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Address < hosts[j].Address
+	})
+	return
+}
+
+func (b *LANBrowser) loop() {
+	buffer := make([]byte, NetBufferSize)
+	for {
+		n, addr, err := b.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if !os.IsTimeout(err) && !strings.HasSuffix(err.Error(), "closed network connection") {
+				fmt.Println(err)
+			}
+			return
+		}
+		packet := buffer[:n]
+		if !isControlPacket(packet) || packet[len(controlMagic)] != controlAdvert {
+			continue
+		}
+		payload := packet[len(controlMagic)+1:]
+		if len(payload) < 10 {
+			continue
+		}
+		// Anyone we could not play with is not worth listing.
+		if binary.LittleEndian.Uint16(payload) != NetProtocolVersion || binary.LittleEndian.Uint64(payload[2:]) != NetFingerprint {
+			continue
+		}
+		b.lock.Lock()
+		b.hosts[addr.String()] = LANHost{
+			Address: addr.String(),
+			Info:    append([]byte(nil), payload[10:]...),
+			seen:    time.Now(),
+		}
+		b.lock.Unlock()
+	}
+}
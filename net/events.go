@@ -30,3 +30,70 @@ type EventMessage struct {
 	Peer    *Peer
 	Message Message
 }
+
+type EventRegistered struct {
+	Lobby string
+}
+
+type EventEndpoint struct {
+	Lobby   string
+	Address string
+}
+
+type EventLobbies struct {
+	Lobbies []string
+}
+
+type EventMatchmakerError struct {
+	Lobby  string
+	Reason string
+}
+
+type EventPunching struct {
+	Address string
+}
+
+type EventPunchFailed struct {
+	Address string
+}
+
+type EventRejected struct {
+	ID     uint32
+	Peer   *Peer
+	Reason string
+}
+
+type EventTimeout struct {
+	ID   uint32
+	Peer *Peer
+}
+
+type EventResumed struct {
+	ID   uint32
+	Peer *Peer
+}
+
+// EventReconnect is sent when a lost peer has come back as a new Peer.
+type EventReconnect struct {
+	ID      uint32
+	Peer    *Peer
+	OldPeer *Peer
+}
+
+// EventRelayJoined is sent when the relay has put us in the host's session.
+type EventRelayJoined struct {
+	Session uint64
+}
+
+// EventRelayError is sent when the relay refuses to put us in a session.
+type EventRelayError struct {
+	Session uint64
+	Reason  string
+}
+
+// EventHostMigrated is sent when our host has left and ID takes over.
+type EventHostMigrated struct {
+	ID      uint32
+	OldPeer *Peer
+	Hosting bool
+}
@@ -0,0 +1,37 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NetLogInterval is how often the same kind of complaint about a packet is printed.
+var NetLogInterval = 5 * time.Second
+
+var packetLog struct {
+	lock    sync.Mutex
+	last    map[string]time.Time
+	skipped map[string]int
+}
+
+// logPacket prints a complaint about a packet, at most once per NetLogInterval for each format.
+func logPacket(format string, args ...interface{}) {
+	packetLog.lock.Lock()
+	defer packetLog.lock.Unlock()
+	if packetLog.last == nil {
+		packetLog.last = make(map[string]time.Time)
+		packetLog.skipped = make(map[string]int)
+	}
+	if time.Since(packetLog.last[format]) < NetLogInterval {
+		packetLog.skipped[format]++
+		return
+	}
+	packetLog.last[format] = time.Now()
+	msg := fmt.Sprintf(format, args...)
+	if skipped := packetLog.skipped[format]; skipped > 0 {
+		msg = fmt.Sprintf("%s (%d more since)", msg, skipped)
+		packetLog.skipped[format] = 0
+	}
+	fmt.Println(msg)
+}
@@ -0,0 +1,220 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAddressInUse = errors.New("address already in use")
+)
+
+// Loopback is an in-memory network for running several ServerClients in one process.
+type Loopback struct {
+	Delay    time.Duration // Added to every datagram.
+	lock     sync.Mutex
+	conns    map[string]*loopbackConn
+	nextPort int
+}
+
+// NewLoopback returns an empty loopback network.
+func NewLoopback(delay time.Duration) *Loopback {
+	return &Loopback{
+		Delay:    delay,
+		conns:    make(map[string]*loopbackConn),
+		nextPort: 40000,
+	}
+}
+
+// Listen opens a conn at the given address. A missing port picks a free one.
+func (l *Loopback) Listen(address string) (net.PacketConn, error) {
+	addr, err := l.ResolveAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr := addr.(*net.UDPAddr)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if udpAddr.Port == 0 {
+		for {
+			udpAddr.Port = l.nextPort
+			l.nextPort++
+			if _, ok := l.conns[udpAddr.String()]; !ok {
+				break
+			}
+		}
+	} else if _, ok := l.conns[udpAddr.String()]; ok {
+		return nil, ErrAddressInUse
+	}
+	c := &loopbackConn{
+		loopback:       l,
+		addr:           udpAddr,
+		packets:        make(chan loopbackPacket, NetChannelSize*4),
+		done:           make(chan struct{}),
+		deadlineChange: make(chan struct{}, 1),
+	}
+	l.conns[udpAddr.String()] = c
+	return c, nil
+}
+
+// ResolveAddr resolves the address as UDP would, placing it on 127.0.0.1 if no host is given.
+func (l *Loopback) ResolveAddr(address string) (net.Addr, error) {
+	if address == "" {
+		address = "127.0.0.1:0"
+	} else if address[0] == ':' {
+		address = "127.0.0.1" + address
+	}
+	return net.ResolveUDPAddr("udp", address)
+}
+
+func (l *Loopback) Direct() bool {
+	return true
+}
+
+// deliver passes a datagram on to whoever is listening at the address, if anyone.
+func (l *Loopback) deliver(b []byte, from, to net.Addr) {
+	l.lock.Lock()
+	c := l.conns[to.String()]
+	l.lock.Unlock()
+	if c == nil {
+		return
+	}
+	packet := loopbackPacket{
+		b:    append([]byte(nil), b...),
+		addr: from,
+	}
+	if l.Delay <= 0 {
+		c.push(packet)
+		return
+	}
+	time.AfterFunc(l.Delay, func() {
+		c.push(packet)
+	})
+}
+
+type loopbackPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// loopbackConn is a single conn on a Loopback.
+type loopbackConn struct {
+	loopback *Loopback
+	addr     *net.UDPAddr
+	packets  chan loopbackPacket
+	done     chan struct{}
+	once     sync.Once
+	// Deadlines for the conn.
+	deadlineLock   sync.Mutex
+	readDeadline   time.Time
+	writeDeadline  time.Time
+	deadlineChange chan struct{}
+}
+
+// push queues a datagram to be read. If the queue is full it is dropped, just as the OS would.
+func (c *loopbackConn) push(packet loopbackPacket) {
+	select {
+	case c.packets <- packet:
+	case <-c.done:
+	default:
+	}
+}
+
+// ReadFrom blocks until a datagram arrives, the read deadline passes, or the conn is closed.
+func (c *loopbackConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		c.deadlineLock.Lock()
+		deadline := c.readDeadline
+		c.deadlineLock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case packet := <-c.packets:
+			n, addr = copy(b, packet.b), packet.addr
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-c.deadlineChange:
+			// Start over with the new deadline.
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		case <-c.done:
+			err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return
+	}
+}
+
+func (c *loopbackConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.deadlineLock.Lock()
+	deadline := c.writeDeadline
+	c.deadlineLock.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.loopback.deliver(b, c.addr, addr)
+	return len(b), nil
+}
+
+func (c *loopbackConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.loopback.lock.Lock()
+		delete(c.loopback.conns, c.addr.String())
+		c.loopback.lock.Unlock()
+	})
+	return nil
+}
+
+func (c *loopbackConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *loopbackConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for ReadFrom, including one that is already blocked.
+func (c *loopbackConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	c.readDeadline = t
+	c.deadlineLock.Unlock()
+	select {
+	case c.deadlineChange <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for WriteTo. A zero time disables the deadline.
+func (c *loopbackConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	c.writeDeadline = t
+	c.deadlineLock.Unlock()
+	return nil
+}
@@ -0,0 +1,47 @@
+package net
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoopbackDeadlines(t *testing.T) {
+	loopback := NewLoopback(0)
+	conn, err := loopback.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A read that is already blocked picks up a new deadline.
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 16))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	select {
+	case err := <-errs:
+		if !os.IsTimeout(err) {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read did not time out")
+	}
+
+	conn.SetWriteDeadline(time.Now())
+	if _, err := conn.WriteTo([]byte{1}, conn.LocalAddr()); !os.IsTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	// Clearing the deadlines lets datagrams through again.
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.WriteTo([]byte{1}, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := conn.ReadFrom(make([]byte, 16)); err != nil || n != 1 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,167 @@
+package net
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LossyConfig describes the network conditions a LossyConn simulates.
+type LossyConfig struct {
+	Seed         int64
+	Loss         float64       // Chance of a packet being dropped, from 0 to 1.
+	Latency      time.Duration // Delay added to every packet.
+	Jitter       time.Duration // Up to this much extra delay, chosen per packet.
+	Duplicate    float64       // Chance of a packet being sent twice.
+	Reorder      float64       // Chance of a packet being held back so that later packets overtake it.
+	ReorderDelay time.Duration // How long a reordered packet is held back. Defaults to Latency+Jitter, or 10ms if both are zero.
+}
+
+// LossyConn wraps a net.PacketConn, dropping, delaying, duplicating, and reordering writes.
+type LossyConn struct {
+	net.PacketConn
+	config  LossyConfig
+	rng     *rand.Rand
+	lock    sync.Mutex
+	pending lossyQueue
+	seq     uint64
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewLossyConn wraps the given conn. It can be used with ServerClient.WrapConn.
+func NewLossyConn(conn net.PacketConn, config LossyConfig) *LossyConn {
+	if config.ReorderDelay == 0 {
+		config.ReorderDelay = config.Latency + config.Jitter
+		if config.ReorderDelay == 0 {
+			config.ReorderDelay = 10 * time.Millisecond
+		}
+	}
+	c := &LossyConn{
+		PacketConn: conn,
+		config:     config,
+		rng:        rand.New(rand.NewSource(config.Seed)),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+// WriteTo queues the packet to be sent once its simulated delay passes.
+func (c *LossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.lock.Lock()
+	// Always draw the same amount of numbers per packet so one choice never shifts the others.
+	lost := c.rng.Float64() < c.config.Loss
+	duplicated := c.rng.Float64() < c.config.Duplicate
+	reordered := c.rng.Float64() < c.config.Reorder
+	var jitter, dupJitter time.Duration
+	if c.config.Jitter > 0 {
+		jitter = time.Duration(c.rng.Int63n(int64(c.config.Jitter)))
+		dupJitter = time.Duration(c.rng.Int63n(int64(c.config.Jitter)))
+	}
+
+	if !lost {
+		delay := c.config.Latency + jitter
+		if reordered {
+			delay += c.config.ReorderDelay
+		}
+		c.push(b, addr, delay)
+		if duplicated {
+			c.push(b, addr, c.config.Latency+dupJitter)
+		}
+	}
+	c.lock.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+// Close stops sending any packets still in flight and closes the wrapped conn.
+func (c *LossyConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.PacketConn.Close()
+}
+
+func (c *LossyConn) push(b []byte, addr net.Addr, delay time.Duration) {
+	c.seq++
+	heap.Push(&c.pending, &lossyPacket{
+		data: append([]byte(nil), b...),
+		addr: addr,
+		due:  time.Now().Add(delay),
+		seq:  c.seq,
+	})
+}
+
+// loop sends each pending packet when it is due.
+func (c *LossyConn) loop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		c.lock.Lock()
+		wait := time.Hour
+		for c.pending.Len() > 0 {
+			next := c.pending[0]
+			if wait = time.Until(next.due); wait > 0 {
+				break
+			}
+			heap.Pop(&c.pending)
+			c.PacketConn.WriteTo(next.data, next.addr)
+		}
+		c.lock.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+type lossyPacket struct {
+	data []byte
+	addr net.Addr
+	due  time.Time
+	seq  uint64 // Keeps packets due at the same time in the order they were written.
+}
+
+type lossyQueue []*lossyPacket
+
+func (q lossyQueue) Len() int { return len(q) }
+func (q lossyQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q lossyQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *lossyQueue) Push(x interface{}) { *q = append(*q, x.(*lossyPacket)) }
+func (q *lossyQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,110 @@
+package net
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// testSequence is a numbered message, so the order they arrive in can be checked.
+type testSequence struct {
+	N uint32
+}
+
+func (m testSequence) Ident() uint8 {
+	return 250
+}
+
+func (m testSequence) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = binary.LittleEndian.AppendUint32(b, m.N)
+	return
+}
+
+func (m testSequence) FromBytes(b []byte) (Message, int, error) {
+	if len(b) < 5 {
+		return nil, 0, ErrShortMessage
+	}
+	m.N = binary.LittleEndian.Uint32(b[1:])
+	return m, 5, nil
+}
+
+func init() {
+	RegisterMessage(testSequence{})
+}
+
+func TestLossyDeliversInOrder(t *testing.T) {
+	const count = 100
+	loopback := NewLoopback(0)
+
+	var host, joiner ServerClient
+	for i, s := range []*ServerClient{&host, &joiner} {
+		config := LossyConfig{
+			Seed:      int64(i + 1),
+			Loss:      0.1,
+			Latency:   2 * time.Millisecond,
+			Jitter:    5 * time.Millisecond,
+			Duplicate: 0.1,
+			Reorder:   0.1,
+		}
+		s.Init()
+		s.Transport = loopback
+		s.Relay = ""
+		s.WrapConn = func(conn net.PacketConn) net.PacketConn {
+			return NewLossyConn(conn, config)
+		}
+	}
+	host.Hosting = true
+
+	if err := host.Open(""); err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	if err := joiner.Open(""); err != nil {
+		t.Fatal(err)
+	}
+	defer joiner.Close()
+	if err := joiner.ConnectTo(host.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := waitForEvent(t, &host, 10*time.Second, func(ev Event) bool {
+		_, ok := ev.(EventConnect)
+		return ok
+	})
+	waitForEvent(t, &joiner, 10*time.Second, func(ev Event) bool {
+		_, ok := ev.(EventJoined)
+		return ok
+	})
+
+	// Sending blocks once the send window fills, so send alongside reading.
+	peer := ev.(EventConnect).Peer
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := peer.Send(testSequence{N: uint32(i)}); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < count; i++ {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		default:
+		}
+		ev := waitForEvent(t, &joiner, 20*time.Second, func(ev Event) bool {
+			msg, ok := ev.(EventMessage)
+			if !ok {
+				return false
+			}
+			_, ok = msg.Message.(testSequence)
+			return ok
+		})
+		if n := ev.(EventMessage).Message.(testSequence).N; n != uint32(i) {
+			t.Fatalf("got message %d, want %d", n, i)
+		}
+	}
+}
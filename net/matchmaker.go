@@ -0,0 +1,307 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	ErrNoMatchmaker = errors.New("no matchmaker")
+)
+
+// Matchmaker messages are sent as raw UDP datagrams, outside of any KCP session.
+var matchmakerRegistry = map[uint8]Message{}
+
+func registerMatchmakerMessage(m Message) {
+	matchmakerRegistry[m.Ident()] = m
+}
+
+// MatchmakerMessageFromBytes decodes a single matchmaker datagram, or returns nil.
+func MatchmakerMessageFromBytes(b []byte) Message {
+	if len(b) == 0 || matchmakerRegistry[b[0]] == nil {
+		return nil
+	}
+	msg := reflect.New(reflect.ValueOf(matchmakerRegistry[b[0]]).Type()).Interface().(Message)
+	msg, n, err := msg.FromBytes(b)
+	if err != nil || n != len(b) {
+		return nil
+	}
+	return msg
+}
+
+// MatchmakerRegister advertises a lobby under the given name until it stops being resent.
+type MatchmakerRegister struct {
+	Lobby string
+}
+
+func (m MatchmakerRegister) Ident() uint8 {
+	return 100
+}
+
+func (m MatchmakerRegister) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Lobby)
+	return
+}
+
+func (m MatchmakerRegister) FromBytes(b []byte) (Message, int, error) {
+	s, n := ReadString(b[1:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	return MatchmakerRegister{Lobby: s}, 1 + n, nil
+}
+
+// MatchmakerUnregister is sent by a host to remove its lobby.
+type MatchmakerUnregister struct {
+	Lobby string
+}
+
+func (m MatchmakerUnregister) Ident() uint8 {
+	return 101
+}
+
+func (m MatchmakerUnregister) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Lobby)
+	return
+}
+
+func (m MatchmakerUnregister) FromBytes(b []byte) (Message, int, error) {
+	s, n := ReadString(b[1:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	return MatchmakerUnregister{Lobby: s}, 1 + n, nil
+}
+
+// MatchmakerLookup is sent by a joiner to request the endpoint of the named lobby's host.
+type MatchmakerLookup struct {
+	Lobby string
+}
+
+func (m MatchmakerLookup) Ident() uint8 {
+	return 102
+}
+
+func (m MatchmakerLookup) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Lobby)
+	return
+}
+
+func (m MatchmakerLookup) FromBytes(b []byte) (Message, int, error) {
+	s, n := ReadString(b[1:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	return MatchmakerLookup{Lobby: s}, 1 + n, nil
+}
+
+// MatchmakerList requests the names of all open lobbies.
+type MatchmakerList struct {
+}
+
+func (m MatchmakerList) Ident() uint8 {
+	return 103
+}
+
+func (m MatchmakerList) ToBytes() []byte {
+	return []byte{m.Ident()}
+}
+
+func (m MatchmakerList) FromBytes(b []byte) (Message, int, error) {
+	return m, 1, nil
+}
+
+// MatchmakerRegistered confirms a MatchmakerRegister.
+type MatchmakerRegistered struct {
+	Lobby string
+}
+
+func (m MatchmakerRegistered) Ident() uint8 {
+	return 104
+}
+
+func (m MatchmakerRegistered) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Lobby)
+	return
+}
+
+func (m MatchmakerRegistered) FromBytes(b []byte) (Message, int, error) {
+	s, n := ReadString(b[1:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	return MatchmakerRegistered{Lobby: s}, 1 + n, nil
+}
+
+// MatchmakerEndpoint tells the receiver the public endpoint of the other side of a lobby.
+type MatchmakerEndpoint struct {
+	Lobby   string
+	Address string
+}
+
+func (m MatchmakerEndpoint) Ident() uint8 {
+	return 105
+}
+
+func (m MatchmakerEndpoint) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Lobby)
+	b = AppendString(b, m.Address)
+	return
+}
+
+func (m MatchmakerEndpoint) FromBytes(b []byte) (Message, int, error) {
+	offset := 1
+	lobby, n := ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	offset += n
+	address, n := ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	offset += n
+	return MatchmakerEndpoint{Lobby: lobby, Address: address}, offset, nil
+}
+
+// MatchmakerLobbies is the response to MatchmakerList.
+type MatchmakerLobbies struct {
+	Lobbies []string
+}
+
+func (m MatchmakerLobbies) Ident() uint8 {
+	return 106
+}
+
+func (m MatchmakerLobbies) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.Lobbies)))
+	for _, l := range m.Lobbies {
+		b = AppendString(b, l)
+	}
+	return
+}
+
+func (m MatchmakerLobbies) FromBytes(b []byte) (Message, int, error) {
+	if len(b) < 3 {
+		return nil, 0, ErrShortMessage
+	}
+	count := int(binary.LittleEndian.Uint16(b[1:]))
+	offset := 3
+	for i := 0; i < count; i++ {
+		s, n := ReadString(b[offset:])
+		if n < 0 {
+			return nil, 0, ErrShortMessage
+		}
+		m.Lobbies = append(m.Lobbies, s)
+		offset += n
+	}
+	return m, offset, nil
+}
+
+// MatchmakerError is sent in response to a request that could not be fulfilled.
+type MatchmakerError struct {
+	Lobby  string
+	Reason string
+}
+
+func (m MatchmakerError) Ident() uint8 {
+	return 107
+}
+
+func (m MatchmakerError) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Lobby)
+	b = AppendString(b, m.Reason)
+	return
+}
+
+func (m MatchmakerError) FromBytes(b []byte) (Message, int, error) {
+	offset := 1
+	lobby, n := ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	offset += n
+	reason, n := ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	offset += n
+	return MatchmakerError{Lobby: lobby, Reason: reason}, offset, nil
+}
+
+// Reasons sent in MatchmakerError.
+const (
+	MatchmakerReasonTaken    = "lobby name taken"
+	MatchmakerReasonNotFound = "lobby not found"
+	MatchmakerReasonBadName  = "bad lobby name"
+)
+
+func init() {
+	registerMatchmakerMessage(MatchmakerRegister{})
+	registerMatchmakerMessage(MatchmakerUnregister{})
+	registerMatchmakerMessage(MatchmakerLookup{})
+	registerMatchmakerMessage(MatchmakerList{})
+	registerMatchmakerMessage(MatchmakerRegistered{})
+	registerMatchmakerMessage(MatchmakerEndpoint{})
+	registerMatchmakerMessage(MatchmakerLobbies{})
+	registerMatchmakerMessage(MatchmakerError{})
+}
+
+// RegisterLobby advertises us as the host of the given lobby.
+func (s *ServerClient) RegisterLobby(lobby string) error {
+	s.lobby = lobby
+	return s.sendToMatchmaker(MatchmakerRegister{Lobby: lobby})
+}
+
+// LookupLobby asks the matchmaker for the host of the given lobby.
+func (s *ServerClient) LookupLobby(lobby string) error {
+	s.lobby = lobby
+	return s.sendToMatchmaker(MatchmakerLookup{Lobby: lobby})
+}
+
+// ListLobbies asks the matchmaker for all open lobbies. The result arrives as an EventLobbies.
+func (s *ServerClient) ListLobbies() error {
+	return s.sendToMatchmaker(MatchmakerList{})
+}
+
+func (s *ServerClient) sendToMatchmaker(msg Message) error {
+	if s.matchmakerAddr == nil {
+		return ErrNoMatchmaker
+	}
+	_, err := s.localConn.WriteTo(msg.ToBytes(), s.matchmakerAddr)
+	return err
+}
+
+func (s *ServerClient) handleMatchmakerPacket(packet Packet) {
+	msg := MatchmakerMessageFromBytes(packet.buffer[:packet.readBytes])
+	switch msg := msg.(type) {
+	case MatchmakerRegistered:
+		s.EventChan <- EventRegistered{Lobby: msg.Lobby}
+	case MatchmakerEndpoint:
+		if msg.Lobby != s.lobby {
+			return
+		}
+		s.EventChan <- EventEndpoint{Lobby: msg.Lobby, Address: msg.Address}
+		// Both sides punch towards each other, as the host is told of the joiner's endpoint as well.
+		if s.Hosting || len(s.Peers()) == 0 {
+			if err := s.beginPunch(msg.Address); err != nil {
+				fmt.Println(err)
+			}
+		}
+	case MatchmakerLobbies:
+		s.EventChan <- EventLobbies{Lobbies: msg.Lobbies}
+	case MatchmakerError:
+		s.EventChan <- EventMatchmakerError{Lobby: msg.Lobby, Reason: msg.Reason}
+	default:
+		logPacket("bad matchmaker packet from %s", packet.addr)
+	}
+}
@@ -0,0 +1,133 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// MatchmakerMaxListed is the maximum amount of lobbies sent in a single MatchmakerLobbies response.
+var MatchmakerMaxListed = 64
+
+// MatchmakerServer tracks lobby names against their hosts' public endpoints.
+type MatchmakerServer struct {
+	Expire  time.Duration // How long a lobby lives without being re-registered.
+	conn    *net.UDPConn
+	lobbies map[string]*matchmakerLobby
+}
+
+type matchmakerLobby struct {
+	addr *net.UDPAddr
+	seen time.Time
+}
+
+// Open starts listening on the given address.
+func (m *MatchmakerServer) Open(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	if m.Expire == 0 {
+		m.Expire = 30 * time.Second
+	}
+	m.conn = conn
+	m.lobbies = make(map[string]*matchmakerLobby)
+	return nil
+}
+
+// LocalAddr returns the address the matchmaker is listening on.
+func (m *MatchmakerServer) LocalAddr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// Run handles requests until the matchmaker is closed.
+func (m *MatchmakerServer) Run() error {
+	buffer := make([]byte, NetBufferSize)
+	for {
+		m.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := m.conn.ReadFromUDP(buffer)
+		m.expire()
+		if err != nil {
+			if os.IsTimeout(err) {
+				continue
+			}
+			return err
+		}
+		if msg := MatchmakerMessageFromBytes(buffer[:n]); msg != nil {
+			m.handle(msg, addr)
+		}
+	}
+}
+
+// Close stops the matchmaker.
+func (m *MatchmakerServer) Close() error {
+	return m.conn.Close()
+}
+
+func (m *MatchmakerServer) expire() {
+	for name, l := range m.lobbies {
+		if time.Since(l.seen) > m.Expire {
+			fmt.Println("lobby expired", name, l.addr)
+			delete(m.lobbies, name)
+		}
+	}
+}
+
+func (m *MatchmakerServer) send(msg Message, addr *net.UDPAddr) {
+	if _, err := m.conn.WriteToUDP(msg.ToBytes(), addr); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (m *MatchmakerServer) handle(msg Message, addr *net.UDPAddr) {
+	switch msg := msg.(type) {
+	case MatchmakerRegister:
+		if msg.Lobby == "" {
+			m.send(MatchmakerError{Lobby: msg.Lobby, Reason: MatchmakerReasonBadName}, addr)
+			return
+		}
+		if l, ok := m.lobbies[msg.Lobby]; ok && l.addr.String() != addr.String() {
+			m.send(MatchmakerError{Lobby: msg.Lobby, Reason: MatchmakerReasonTaken}, addr)
+			return
+		}
+		if _, ok := m.lobbies[msg.Lobby]; !ok {
+			fmt.Println("lobby registered", msg.Lobby, addr)
+		}
+		m.lobbies[msg.Lobby] = &matchmakerLobby{
+			addr: addr,
+			seen: time.Now(),
+		}
+		m.send(MatchmakerRegistered{Lobby: msg.Lobby}, addr)
+	case MatchmakerUnregister:
+		if l, ok := m.lobbies[msg.Lobby]; ok && l.addr.String() == addr.String() {
+			fmt.Println("lobby unregistered", msg.Lobby, addr)
+			delete(m.lobbies, msg.Lobby)
+		}
+	case MatchmakerLookup:
+		l, ok := m.lobbies[msg.Lobby]
+		if !ok {
+			m.send(MatchmakerError{Lobby: msg.Lobby, Reason: MatchmakerReasonNotFound}, addr)
+			return
+		}
+		logPacket("lobby lookup %s %s -> %s", msg.Lobby, addr, l.addr)
+		// Let both sides know about each other so either can begin talking.
+		m.send(MatchmakerEndpoint{Lobby: msg.Lobby, Address: l.addr.String()}, addr)
+		m.send(MatchmakerEndpoint{Lobby: msg.Lobby, Address: addr.String()}, l.addr)
+	case MatchmakerList:
+		var names []string
+		for name := range m.lobbies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > MatchmakerMaxListed {
+			names = names[:MatchmakerMaxListed]
+		}
+		m.send(MatchmakerLobbies{Lobbies: names}, addr)
+	}
+}
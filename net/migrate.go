@@ -0,0 +1,168 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Member is a joiner as its host sees it.
+type Member struct {
+	ID        uint32
+	Address   string // Where the host reaches the joiner. This is a made-up address if it is through the relay.
+	Spectator bool
+}
+
+// MessageMembers is sent by the host to its joiners whenever one comes or goes.
+type MessageMembers struct {
+	Lobby   string   // Lobby the host is registered with the matchmaker as, if any.
+	Relay   uint64   // Relay session the host is waiting at, if any.
+	Secret  uint64   // Secret the host proves itself to the relay with, which whoever takes over needs.
+	Members []Member // In the order they joined.
+}
+
+func (m MessageMembers) Ident() uint8 {
+	return 6
+}
+
+func (m MessageMembers) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Lobby)
+	b = binary.LittleEndian.AppendUint64(b, m.Relay)
+	b = binary.LittleEndian.AppendUint64(b, m.Secret)
+	b = append(b, uint8(len(m.Members)))
+	for _, member := range m.Members {
+		b = binary.LittleEndian.AppendUint32(b, member.ID)
+		b = AppendString(b, member.Address)
+		if member.Spectator {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return
+}
+
+func (m MessageMembers) FromBytes(b []byte) (Message, int, error) {
+	offset := 1
+	lobby, n := ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	m.Lobby = lobby
+	offset += n
+	if len(b) < offset+17 {
+		return nil, 0, ErrShortMessage
+	}
+	m.Relay = binary.LittleEndian.Uint64(b[offset:])
+	m.Secret = binary.LittleEndian.Uint64(b[offset+8:])
+	count := int(b[offset+16])
+	offset += 17
+	for i := 0; i < count; i++ {
+		if len(b) < offset+4 {
+			return nil, 0, ErrShortMessage
+		}
+		id := binary.LittleEndian.Uint32(b[offset:])
+		offset += 4
+		address, n := ReadString(b[offset:])
+		if n < 0 || len(b) < offset+n+1 {
+			return nil, 0, ErrShortMessage
+		}
+		offset += n
+		m.Members = append(m.Members, Member{
+			ID:        id,
+			Address:   address,
+			Spectator: b[offset] != 0,
+		})
+		offset++
+	}
+	return m, offset, nil
+}
+
+// syncMembers sends who we are hosting to all of them.
+func (s *ServerClient) syncMembers() {
+	if !s.Hosting {
+		return
+	}
+	msg := MessageMembers{
+		Lobby:  s.lobby,
+		Relay:  s.relaySession,
+		Secret: s.relaySecret,
+	}
+	var peers []*Peer
+	for _, p := range s.Peers() {
+		if p.id == 0 || p.left || p.rejected.Load() {
+			continue
+		}
+		msg.Members = append(msg.Members, Member{
+			ID:        p.id,
+			Address:   p.addr.String(),
+			Spectator: p.Spectator(),
+		})
+		peers = append(peers, p)
+	}
+	for _, p := range peers {
+		p.Send(msg)
+	}
+}
+
+// migrate moves on from a host that has left to the first player that joined it.
+func (s *ServerClient) migrate(host *Peer) {
+	members := s.members
+	s.members = nil
+	s.oldHost = host.addr.String()
+	s.removePeer(host)
+
+	var next *Member
+	for i, m := range members.Members {
+		if !m.Spectator {
+			next = &members.Members[i]
+			break
+		}
+	}
+	if next == nil {
+		fmt.Println("nobody left to take over from host", host.id)
+		return
+	}
+
+	hosting := next.ID == s.id
+	if hosting {
+		s.Hosting = true
+	}
+	s.EventChan <- EventHostMigrated{
+		ID:      next.ID,
+		OldPeer: host,
+		Hosting: hosting,
+	}
+
+	if hosting {
+		fmt.Println("taking over from host", host.id)
+		s.lobby = members.Lobby
+		if s.lobby != "" {
+			if err := s.RegisterLobby(s.lobby); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if members.Relay != 0 {
+			s.relaySecret = members.Secret
+			if s.HostRelay(members.Relay) == nil {
+				return
+			}
+		}
+		for _, m := range members.Members {
+			if m.ID != s.id {
+				if err := s.beginPunch(m.Address); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+		return
+	}
+
+	fmt.Println("host", host.id, "left, moving to", next.ID)
+	if members.Relay != 0 && s.JoinRelay(members.Relay) == nil {
+		return
+	}
+	if err := s.beginPunch(next.Address); err != nil {
+		fmt.Println(err)
+	}
+}
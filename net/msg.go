@@ -2,32 +2,65 @@ package net
 
 import (
 	"encoding/binary"
+	"errors"
 	"reflect"
 )
 
+var (
+	ErrShortMessage      = errors.New("message too short")
+	ErrUnknownMessage    = errors.New("unknown message")
+	ErrUnexpectedMessage = errors.New("unexpected message type")
+	ErrBadCount          = errors.New("bad count in message")
+)
+
 var messageRegistry = map[uint8]Message{}
 
 func RegisterMessage(m Message) {
 	messageRegistry[m.Ident()] = m
 }
 
-func MessageFromBytes(b []byte) (Message, int) {
-	if messageRegistry[b[0]] != nil {
-		msg := reflect.New(reflect.ValueOf(messageRegistry[b[0]]).Type()).Interface().(Message)
-		msg, n := msg.FromBytes(b)
-		return msg, n
+// MessageFromBytes decodes the message at the start of b, returning how many bytes it took up.
+func MessageFromBytes(b []byte) (Message, int, error) {
+	if len(b) == 0 {
+		return nil, 0, ErrShortMessage
+	}
+	if messageRegistry[b[0]] == nil {
+		return nil, 0, ErrUnknownMessage
+	}
+	msg := reflect.New(reflect.ValueOf(messageRegistry[b[0]]).Type()).Interface().(Message)
+	msg, n, err := msg.FromBytes(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n > len(b) {
+		return nil, 0, ErrShortMessage
 	}
-	return nil, 0
+	return msg, n, nil
 }
 
+// Message is anything that can be sent to a peer.
 type Message interface {
 	Ident() uint8
 	ToBytes() []byte
-	FromBytes(b []byte) (Message, int)
+	FromBytes(b []byte) (Message, int, error)
 }
 
+// MaxMessageSize is the largest message a peer may send us.
+const MaxMessageSize = 1 << 20
+
+// NetProtocolVersion must be bumped whenever the wire format of any message changes.
+const NetProtocolVersion uint16 = 12
+
+// NetFingerprint is a hash of the assets that affect the simulation.
+var NetFingerprint uint64
+
+// MessageID is the first message sent to a peer.
 type MessageID struct {
-	ID uint32
+	ID          uint32
+	Version     uint16
+	Fingerprint uint64
+	Token       uint64
+	Spectator   bool // Set if the sender only watches the game.
 }
 
 func (m MessageID) Type() string {
@@ -41,11 +74,59 @@ func (m MessageID) Ident() uint8 {
 func (m MessageID) ToBytes() (b []byte) {
 	b = append(b, m.Ident())
 	b = binary.LittleEndian.AppendUint32(b, m.ID)
+	b = binary.LittleEndian.AppendUint16(b, m.Version)
+	b = binary.LittleEndian.AppendUint64(b, m.Fingerprint)
+	b = binary.LittleEndian.AppendUint64(b, m.Token)
+	if m.Spectator {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
 	return b
 }
 
-func (m MessageID) FromBytes(b []byte) (Message, int) {
-	return MessageID{ID: binary.LittleEndian.Uint32(b[1:])}, 5
+func (m MessageID) FromBytes(b []byte) (Message, int, error) {
+	if len(b) < 24 {
+		return nil, 0, ErrShortMessage
+	}
+	return MessageID{
+		ID:          binary.LittleEndian.Uint32(b[1:]),
+		Version:     binary.LittleEndian.Uint16(b[5:]),
+		Fingerprint: binary.LittleEndian.Uint64(b[7:]),
+		Token:       binary.LittleEndian.Uint64(b[15:]),
+		Spectator:   b[23] != 0,
+	}, 24, nil
+}
+
+// Reasons sent in MessageReject.
+const (
+	RejectReasonVersion     = "Different game version"
+	RejectReasonAssets      = "Different game assets"
+	RejectReasonPassphrase  = "Wrong passphrase"
+	RejectReasonMessageSize = "Message too large"
+)
+
+// MessageReject tells a peer why we will not play with them.
+type MessageReject struct {
+	Reason string
+}
+
+func (m MessageReject) Ident() uint8 {
+	return 4
+}
+
+func (m MessageReject) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = AppendString(b, m.Reason)
+	return
+}
+
+func (m MessageReject) FromBytes(b []byte) (Message, int, error) {
+	s, n := ReadString(b[1:])
+	if n < 0 {
+		return nil, 0, ErrShortMessage
+	}
+	return MessageReject{Reason: s}, 1 + n, nil
 }
 
 type MessageClose struct {
@@ -55,8 +136,8 @@ func (m MessageClose) Ident() uint8 {
 	return 2
 }
 
-func (m MessageClose) FromBytes(b []byte) (Message, int) {
-	return m, 1
+func (m MessageClose) FromBytes(b []byte) (Message, int, error) {
+	return m, 1, nil
 }
 
 func (m MessageClose) ToBytes() []byte {
@@ -77,12 +158,52 @@ func (m MessageRaw) ToBytes() (b []byte) {
 	return
 }
 
-func (m MessageRaw) FromBytes(b []byte) (Message, int) {
-	return MessageRaw{Data: b[1:]}, 1 + len(b)
+// FromBytes treats everything after the first byte as the data.
+func (m MessageRaw) FromBytes(b []byte) (Message, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrShortMessage
+	}
+	return MessageRaw{Data: b[1:]}, len(b), nil
+}
+
+// AppendString appends a string prefixed by its uint8 length.
+func AppendString(b []byte, s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	b = append(b, uint8(len(s)))
+	return append(b, s...)
+}
+
+// ReadString reads a string written by AppendString, returning -1 if b is too short.
+func ReadString(b []byte) (string, int) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", -1
+	}
+	return string(b[1 : 1+int(b[0])]), 1 + int(b[0])
+}
+
+// MessageHeartbeat lets peers know we are still around.
+type MessageHeartbeat struct {
+}
+
+func (m MessageHeartbeat) Ident() uint8 {
+	return 5
+}
+
+func (m MessageHeartbeat) ToBytes() []byte {
+	return []byte{m.Ident()}
+}
+
+func (m MessageHeartbeat) FromBytes(b []byte) (Message, int, error) {
+	return m, 1, nil
 }
 
 func init() {
 	RegisterMessage(MessageID{})
 	RegisterMessage(MessageClose{})
 	RegisterMessage(MessageRaw{})
+	RegisterMessage(MessageReject{})
+	RegisterMessage(MessageHeartbeat{})
+	RegisterMessage(MessageMembers{})
 }
@@ -1,9 +1,12 @@
 package net
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xtaci/kcp-go"
@@ -11,26 +14,74 @@ import (
 
 type Peer struct {
 	id      uint32
-	addr    *net.UDPAddr // Address of the peer
-	conn    *net.UDPConn // Pointer to the serverclient's conn.
+	token   uint64         // Session token the peer identified with.
+	addr    net.Addr       // Address of the peer
+	conn    net.PacketConn // The serverclient's conn.
 	session *kcp.UDPSession
+	// rejected is set once either side refuses the other. Messages from rejected peers are dropped.
+	rejected atomic.Bool
+	// verified is set once a packet from the peer decrypts with our key.
+	verified bool
+	// left is set once the peer has told us it is leaving.
+	left bool
+	// spectator is set if the peer only watches the game.
+	spectator atomic.Bool
+	// Liveness.
+	lastReceived atomic.Int64 // Unix nanoseconds of the last message received.
+	timedOut     atomic.Bool  // Set from timing out until we hear from the peer again.
+	reported     atomic.Bool  // Set once the current timeout has been sent as an event.
+	stats        peerStats
 	// Packet reading.
-	packetBuffer  []byte
-	readLock      sync.Mutex
-	readReadyChan chan bool
+	packets chan []byte
+	// Deadlines for the virtual packet conn.
+	deadlineLock   sync.Mutex
+	readDeadline   time.Time
+	writeDeadline  time.Time
+	deadlineChange chan struct{}
+	closeChan      chan struct{}
+	closeOnce      sync.Once
+	// Message framing.
+	recvBuffer []byte // Bytes read from the session that do not yet form a whole message.
+	sendBuffer []byte // Framed messages waiting to be flushed.
+	sendLock   sync.Mutex
 }
 
 type PeerPacket struct {
 	peer *Peer
 	msg  Message
+	drop string // Set in place of msg if the peer has to be dropped, giving the reason.
 }
 
-func NewPeer(addr *net.UDPAddr, conn *net.UDPConn) *Peer {
-	return &Peer{
-		addr:          addr,
-		conn:          conn,
-		readReadyChan: make(chan bool, NetChannelSize),
+func NewPeer(addr net.Addr, conn net.PacketConn) *Peer {
+	p := &Peer{
+		addr:           addr,
+		conn:           conn,
+		packets:        make(chan []byte, NetChannelSize),
+		deadlineChange: make(chan struct{}, 1),
+		closeChan:      make(chan struct{}),
 	}
+	p.lastReceived.Store(time.Now().UnixNano())
+	return p
+}
+
+// Idle returns how long it has been since we last heard from the peer.
+func (p *Peer) Idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - p.lastReceived.Load())
+}
+
+// TimedOut returns if the peer has been idle for longer than NetTimeout.
+func (p *Peer) TimedOut() bool {
+	return p.timedOut.Load()
+}
+
+// Spectator returns whether the peer joined only to watch.
+func (p *Peer) Spectator() bool {
+	return p.spectator.Load()
+}
+
+// Rejected returns whether either side has refused to play with the other.
+func (p *Peer) Rejected() bool {
+	return p.rejected.Load()
 }
 
 func (p *Peer) ID() uint32 {
@@ -39,64 +90,185 @@ func (p *Peer) ID() uint32 {
 
 // writeToPacketBuffer is used internally to write from the single UDP connection to a virtual packet buffer for use by the Peer.
 func (p *Peer) writeToPacketBuffer(b []byte) {
-	p.readLock.Lock()
-	p.packetBuffer = append(p.packetBuffer, b...)
-	p.readLock.Unlock()
-	p.readReadyChan <- true
+	p.stats.bytesIn.Add(uint64(len(b)))
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	select {
+	case p.packets <- packet:
+	default:
+		logPacket("dropping packet for %s", p.addr)
+	}
 }
 
+// loop reads from the session and splits the stream back into messages.
 func (p *Peer) loop(ch chan PeerPacket) {
+	b := make([]byte, NetBufferSize)
 	for {
-		b := make([]byte, NetBufferSize)
 		n, err := p.session.Read(b)
-
-		msg, _ := MessageFromBytes(b[:n])
-		if msg == nil {
-			fmt.Println("unknown message ID:", b[0], "passing as raw message.")
-			msg, _ = MessageRaw{}.FromBytes(b[:n])
-		}
-
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		ch <- PeerPacket{
-			peer: p,
-			msg:  msg,
+		p.recvBuffer = append(p.recvBuffer, b[:n]...)
+
+		for {
+			size, sizeLength := binary.Uvarint(p.recvBuffer)
+			if sizeLength < 0 || (sizeLength > 0 && size > MaxMessageSize) {
+				// There is no telling where the next message starts.
+				logPacket("bad message length from %s", p.addr)
+				p.recvBuffer = nil
+				ch <- PeerPacket{
+					peer: p,
+					drop: RejectReasonMessageSize,
+				}
+				return
+			} else if sizeLength == 0 || uint64(len(p.recvBuffer)-sizeLength) < size {
+				break
+			}
+			frame := p.recvBuffer[sizeLength : sizeLength+int(size)]
+			p.recvBuffer = p.recvBuffer[sizeLength+int(size):]
+			if len(frame) == 0 {
+				continue
+			}
+
+			msg, _, err := MessageFromBytes(frame)
+			if err == ErrUnknownMessage {
+				logPacket("unknown message ID %d from %s, passing as raw message", frame[0], p.addr)
+				msg = MessageRaw{Data: frame[1:]}
+			} else if err != nil {
+				// The frame is already split off, so dropping it leaves the rest of the stream intact.
+				logPacket("dropping malformed message %d from %s: %s", frame[0], p.addr, err)
+				continue
+			}
+			ch <- PeerPacket{
+				peer: p,
+				msg:  msg,
+			}
 		}
 	}
 }
 
-// Send sends a Payload to the given peer.
-func (p *Peer) Send(msg Message) error {
+// Queue frames a message to be sent with the next Flush.
+func (p *Peer) Queue(msg Message) error {
 	if p.session == nil {
 		return fmt.Errorf("no sesssion")
 	}
-	//p.conn.WriteTo(msg.ToBytes(), p.addr)
-	p.session.Write(msg.ToBytes())
-	//p.encoder.Encode(&msg)
+	b := msg.ToBytes()
+	p.sendLock.Lock()
+	p.sendBuffer = binary.AppendUvarint(p.sendBuffer, uint64(len(b)))
+	p.sendBuffer = append(p.sendBuffer, b...)
+	p.sendLock.Unlock()
 	return nil
 }
 
+// Flush writes all queued messages to the session at once.
+func (p *Peer) Flush() error {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	if len(p.sendBuffer) == 0 {
+		return nil
+	}
+	// Spectators must not hold up the players.
+	if p.spectator.Load() {
+		p.session.SetWriteDeadline(time.Now().Add(NetSpectatorWriteTimeout))
+	}
+	_, err := p.session.Write(p.sendBuffer)
+	p.sendBuffer = p.sendBuffer[:0]
+	return err
+}
+
+// Heartbeat lets the peer know we are still around, unless it is hearing from us anyway.
+func (p *Peer) Heartbeat() {
+	p.trySend(MessageHeartbeat{})
+}
+
+// trySend sends a message only if it can go straight out.
+func (p *Peer) trySend(msg Message) {
+	if p.session == nil || !p.sendLock.TryLock() {
+		return
+	}
+	defer p.sendLock.Unlock()
+	if len(p.sendBuffer) > 0 {
+		return
+	}
+	b := msg.ToBytes()
+	frame := binary.AppendUvarint(nil, uint64(len(b)))
+	frame = append(frame, b...)
+	p.session.SetWriteDeadline(time.Now())
+	p.session.Write(frame)
+	p.session.SetWriteDeadline(time.Time{})
+}
+
+// Send sends a single message to the given peer immediately.
+func (p *Peer) Send(msg Message) error {
+	if err := p.Queue(msg); err != nil {
+		return err
+	}
+	return p.Flush()
+}
+
 // ReadFrom is used to read from the peer's virtual packet buffer.
 func (p *Peer) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
-	<-p.readReadyChan
-	addr = p.addr
-	p.readLock.Lock()
-	n = copy(b, p.packetBuffer)
-	p.packetBuffer = p.packetBuffer[n:]
-	p.readLock.Unlock()
-	return
+	for {
+		p.deadlineLock.Lock()
+		deadline := p.readDeadline
+		p.deadlineLock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, p.addr, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case packet := <-p.packets:
+			n, addr = copy(b, packet), p.addr
+		case <-timeout:
+			addr, err = p.addr, os.ErrDeadlineExceeded
+		case <-p.deadlineChange:
+			// Start over with the new deadline.
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		case <-p.closeChan:
+			addr, err = p.addr, net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return
+	}
 }
 
 // WriteTo writes the bytes to the given address.
 func (p *Peer) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-p.closeChan:
+		return 0, net.ErrClosed
+	default:
+	}
+	p.deadlineLock.Lock()
+	deadline := p.writeDeadline
+	p.deadlineLock.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
 	n, err = p.conn.WriteTo(b, addr)
+	p.stats.bytesOut.Add(uint64(n))
 	return
 }
 
-// Close closes the peer connection. (it actually does nothing!)
+// Close closes the peer's virtual packet conn, waking any pending reads.
 func (p *Peer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+	})
 	return nil
 }
 
@@ -105,20 +277,28 @@ func (p *Peer) LocalAddr() net.Addr {
 	return p.addr
 }
 
-// SetDeadline does nothing.
+// SetDeadline sets both the read and write deadlines.
 func (p *Peer) SetDeadline(t time.Time) error {
-	fmt.Println("TODO: Peer.SetDeadline")
-	return nil
+	p.SetWriteDeadline(t)
+	return p.SetReadDeadline(t)
 }
 
-// SetReadDeadline does nothing.
+// SetReadDeadline sets the deadline for ReadFrom, including one that is already blocked.
 func (p *Peer) SetReadDeadline(t time.Time) error {
-	fmt.Println("TODO: Peer.SetReadDeadline")
+	p.deadlineLock.Lock()
+	p.readDeadline = t
+	p.deadlineLock.Unlock()
+	select {
+	case p.deadlineChange <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
-// SetWriteDeadline does nothing.
+// SetWriteDeadline sets the deadline for WriteTo. A zero time disables the deadline.
 func (p *Peer) SetWriteDeadline(t time.Time) error {
-	fmt.Println("TODO: Peer.SetWriteDeadline")
+	p.deadlineLock.Lock()
+	p.writeDeadline = t
+	p.deadlineLock.Unlock()
 	return nil
 }
@@ -0,0 +1,68 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+var NetPunchInterval = 200 * time.Millisecond
+var NetPunchTimeout = 10 * time.Second
+
+// punch is an in-progress attempt at opening a path through NAT to a remote endpoint.
+type punch struct {
+	addr    net.Addr
+	started time.Time
+}
+
+// beginPunch starts sending probes to the given endpoint from our one UDP connection.
+func (s *ServerClient) beginPunch(address string) error {
+	addr, err := s.Transport.ResolveAddr(address)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.punches[addr.String()]; ok {
+		return nil
+	}
+	s.punches[addr.String()] = &punch{
+		addr:    addr,
+		started: time.Now(),
+	}
+	s.EventChan <- EventPunching{Address: addr.String()}
+	return s.sendControl(controlPunch, addr)
+}
+
+// refreshPunches resends probes and gives up on any that have taken too long.
+func (s *ServerClient) refreshPunches() {
+	for key, p := range s.punches {
+		if time.Since(p.started) > NetPunchTimeout {
+			delete(s.punches, key)
+			fmt.Println("failed to punch through to", p.addr)
+			s.EventChan <- EventPunchFailed{Address: key}
+			continue
+		}
+		if err := s.sendControl(controlPunch, p.addr); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// handlePunch handles a probe or probe acknowledgement.
+func (s *ServerClient) handlePunch(kind uint8, addr net.Addr) {
+	if kind == controlPunch {
+		if err := s.sendControl(controlPunchAck, addr); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if _, ok := s.punches[addr.String()]; !ok {
+		return
+	}
+	delete(s.punches, addr.String())
+	fmt.Println("punched through to", addr)
+
+	if !s.Hosting && len(s.Peers()) == 0 {
+		if err := s.ConnectTo(addr.String()); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
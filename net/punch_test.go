@@ -0,0 +1,72 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+// waitForEvent reads events until one satisfies match.
+func waitForEvent(t *testing.T, s *ServerClient, timeout time.Duration, match func(Event) bool) Event {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev := <-s.EventChan:
+			if match(ev) {
+				return ev
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for event")
+			return nil
+		}
+	}
+}
+
+func TestPunchThroughMatchmaker(t *testing.T) {
+	var matchmaker MatchmakerServer
+	if err := matchmaker.Open("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go matchmaker.Run()
+	defer matchmaker.Close()
+
+	var host, joiner ServerClient
+	for _, s := range []*ServerClient{&host, &joiner} {
+		s.Init()
+		s.Transport = UDPTransport{}
+		s.Relay = ""
+		s.Matchmaker = matchmaker.LocalAddr().String()
+		s.UseMatchmaker = true
+	}
+	host.Hosting = true
+
+	if err := host.Open("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	if err := host.RegisterLobby("punch"); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, &host, 5*time.Second, func(ev Event) bool {
+		_, ok := ev.(EventRegistered)
+		return ok
+	})
+
+	if err := joiner.Open("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer joiner.Close()
+	if err := joiner.LookupLobby("punch"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The host only hears of the joiner connecting, as it is the one being joined.
+	waitForEvent(t, &joiner, 10*time.Second, func(ev Event) bool {
+		_, ok := ev.(EventJoined)
+		return ok
+	})
+	waitForEvent(t, &host, 10*time.Second, func(ev Event) bool {
+		_, ok := ev.(EventConnect)
+		return ok
+	})
+}
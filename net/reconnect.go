@@ -0,0 +1,104 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// redial is a joiner's in-progress attempt at resuming its session with the host.
+type redial struct {
+	addr    net.Addr
+	old     *Peer
+	started time.Time
+}
+
+// Reconnect tries to get a timed out peer back.
+func (s *ServerClient) Reconnect(peer *Peer) {
+	s.reconnectChan <- peer
+}
+
+// reconnect does the work of Reconnect from within the logic loop.
+func (s *ServerClient) reconnect(peer *Peer) {
+	if s.Hosting {
+		peer.lastReceived.Store(time.Now().UnixNano())
+		peer.reported.Store(false)
+		peer.Heartbeat()
+		return
+	}
+
+	s.reconnecting[peer.token] = peer
+	s.removePeer(peer)
+	s.redial = &redial{
+		addr:    peer.addr,
+		old:     peer,
+		started: time.Now(),
+	}
+	fmt.Println("reconnecting to", peer.addr)
+	s.sendSignedControl(controlReconnect, peer.addr, binary.LittleEndian.AppendUint64(nil, s.token)...)
+}
+
+// refreshRedial resends our reconnect request until the host acknowledges it or we give up.
+func (s *ServerClient) refreshRedial() {
+	if s.redial == nil {
+		return
+	}
+	if time.Since(s.redial.started) > NetTimeout {
+		fmt.Println("failed to reconnect to", s.redial.addr)
+		old := s.redial.old
+		s.redial = nil
+		delete(s.reconnecting, old.token)
+		if s.canMigrate() {
+			s.migrate(old)
+			return
+		}
+		s.EventChan <- EventTimeout{
+			Peer: old,
+			ID:   old.id,
+		}
+		return
+	}
+	s.sendSignedControl(controlReconnect, s.redial.addr, binary.LittleEndian.AppendUint64(nil, s.token)...)
+}
+
+// handleReconnect handles a signed reconnect request or its acknowledgement.
+func (s *ServerClient) handleReconnect(kind uint8, b []byte, addr net.Addr) {
+	payload, ok := s.checkControl(kind, b)
+	if !ok || len(payload) < 8 {
+		logPacket("dropping unsigned reconnect from %s", addr)
+		return
+	}
+	token := binary.LittleEndian.Uint64(payload)
+
+	if kind == controlReconnectAck {
+		if s.redial == nil || s.redial.addr.String() != addr.String() || token != s.token {
+			return
+		}
+		s.redial = nil
+		if err := s.ConnectTo(addr.String()); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if !s.Hosting {
+		return
+	}
+	if _, ok := s.reconnecting[token]; !ok {
+		var old *Peer
+		for _, p := range s.Peers() {
+			if p.token == token && !p.rejected.Load() {
+				old = p
+				break
+			}
+		}
+		if old == nil {
+			logPacket("unknown reconnect from %s", addr)
+			return
+		}
+		s.reconnecting[token] = old
+		s.removePeer(old)
+	}
+	s.sendSignedControl(controlReconnectAck, addr, binary.LittleEndian.AppendUint64(nil, token)...)
+}
@@ -0,0 +1,172 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+var (
+	ErrNoRelay = errors.New("no relay")
+)
+
+// NetRelayAddress is the relay used when we cannot reach the other side directly.
+var NetRelayAddress = ""
+
+// Relayed datagrams begin with their session and member. The host is always member 0.
+const relayHeaderSize = 9
+
+// Reasons sent by the relay when it refuses a join.
+const (
+	RelayReasonFull        = "relay full"
+	RelayReasonSessionFull = "relay session full"
+	RelayReasonHostTaken   = "relay session has another host"
+)
+
+// RelaySession returns the relay session ID used for the given lobby.
+func RelaySession(lobby string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(lobby))
+	return h.Sum64()
+}
+
+// relayRoute is where a virtual address leads to through the relay.
+type relayRoute struct {
+	session uint64
+	member  uint8
+}
+
+// relayAddr returns the made-up address we know a member of a relayed session by.
+func relayAddr(session uint64, member uint8) *net.UDPAddr {
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd // Unique local, so it can never be a real peer.
+	binary.BigEndian.PutUint64(ip[1:], session)
+	ip[9] = member
+	return &net.UDPAddr{IP: ip, Port: 1}
+}
+
+// relayConn wraps and unwraps what we send through the relay.
+type relayConn struct {
+	net.PacketConn
+	relay  net.Addr
+	lock   sync.Mutex
+	routes map[string]relayRoute // By virtual address.
+}
+
+func newRelayConn(conn net.PacketConn, relay net.Addr) *relayConn {
+	return &relayConn{
+		PacketConn: conn,
+		relay:      relay,
+		routes:     make(map[string]relayRoute),
+	}
+}
+
+// route makes the given member of a session reachable at its virtual address.
+func (c *relayConn) route(session uint64, member uint8) *net.UDPAddr {
+	addr := relayAddr(session, member)
+	c.lock.Lock()
+	c.routes[addr.String()] = relayRoute{session: session, member: member}
+	c.lock.Unlock()
+	return addr
+}
+
+func (c *relayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil || c.relay == nil || n < relayHeaderSize || addr.String() != c.relay.String() || isControlPacket(b[:n]) {
+		return n, addr, err
+	}
+	from := c.route(binary.LittleEndian.Uint64(b), b[8])
+	copy(b, b[relayHeaderSize:n])
+	return n - relayHeaderSize, from, nil
+}
+
+func (c *relayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.lock.Lock()
+	route, ok := c.routes[addr.String()]
+	c.lock.Unlock()
+	if !ok {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	packet := make([]byte, relayHeaderSize, relayHeaderSize+len(b))
+	binary.LittleEndian.PutUint64(packet, route.session)
+	packet[8] = route.member
+	packet = append(packet, b...)
+	if _, err := c.PacketConn.WriteTo(packet, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// HostRelay registers us as the host of the given relay session.
+func (s *ServerClient) HostRelay(session uint64) error {
+	return s.joinRelay(session)
+}
+
+// JoinRelay connects to the host of the given relay session through the relay.
+func (s *ServerClient) JoinRelay(session uint64) error {
+	return s.joinRelay(session)
+}
+
+func (s *ServerClient) joinRelay(session uint64) error {
+	if s.relayConn == nil || s.relayConn.relay == nil {
+		return ErrNoRelay
+	}
+	s.relaySession = session
+	return s.sendRelayJoin()
+}
+
+func (s *ServerClient) sendRelayJoin() error {
+	payload := binary.LittleEndian.AppendUint64(nil, s.relaySession)
+	if s.Hosting {
+		payload = append(payload, 1)
+		payload = binary.LittleEndian.AppendUint64(payload, s.relaySecret)
+	} else {
+		payload = append(payload, 0)
+	}
+	return s.sendControl(controlRelayJoin, s.relayConn.relay, payload...)
+}
+
+// refreshRelay keeps our relay session alive, or retries joining it.
+func (s *ServerClient) refreshRelay() {
+	if s.relaySession == 0 || (!s.Hosting && len(s.Peers()) > 0) {
+		return
+	}
+	if err := s.sendRelayJoin(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// handleRelayPacket handles the relay's answer to joining a session.
+func (s *ServerClient) handleRelayPacket(kind uint8, b []byte, addr net.Addr) {
+	if s.relayConn == nil || s.relayConn.relay == nil || addr.String() != s.relayConn.relay.String() || len(b) < 8 {
+		return
+	}
+	session := binary.LittleEndian.Uint64(b)
+	if session != s.relaySession {
+		return
+	}
+	switch kind {
+	case controlRelayJoined:
+		if s.Hosting || len(s.Peers()) > 0 {
+			return
+		}
+		// We are going through the relay now, so stop looking for the host with the matchmaker.
+		s.lobby = ""
+		host := s.relayConn.route(session, 0)
+		fmt.Printf("joined relay session %016x, connecting to host\n", session)
+		s.EventChan <- EventRelayJoined{Session: session}
+		if err := s.ConnectTo(host.String()); err != nil {
+			fmt.Println(err)
+		}
+	case controlRelayError:
+		reason, n := ReadString(b[8:])
+		if n < 0 {
+			return
+		}
+		s.relaySession = 0
+		s.EventChan <- EventRelayError{Session: session, Reason: reason}
+	}
+}
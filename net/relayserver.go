@@ -0,0 +1,288 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RelayMaxMembers is the most a relay session may hold, counting its host.
+var RelayMaxMembers = 8
+
+// RelayServer forwards traffic between the host of a session and its joiners.
+type RelayServer struct {
+	Expire        time.Duration    // How long a session lives without any traffic.
+	MaxSessions   int              // How many sessions may be relayed at once.
+	StatsInterval time.Duration    // How often to log the stats of every session. Stats are always logged when a session expires.
+	conns         []net.PacketConn // UDP first, then anything else members may reach us over.
+	sessions      map[uint64]*relaySession
+	members       map[string]relayRoute // Which session and member each address is, by address.
+	lastStats     time.Time
+}
+
+type relaySession struct {
+	id      uint64
+	members []relayMember // The host is first. Left empty until it registers.
+	secret  uint64        // Proves a host that moves, or takes over from the last, is the session's rightful host. Set by whoever registers as host first.
+	created time.Time
+	seen    time.Time
+	packets uint64
+	bytes   uint64
+	dropped uint64
+}
+
+// relayMember is where a member of a session is and which of our conns reaches it.
+type relayMember struct {
+	addr net.Addr
+	conn net.PacketConn
+}
+
+// relayPacket is a datagram read from one of our conns.
+type relayPacket struct {
+	b    []byte
+	addr net.Addr
+	conn net.PacketConn
+}
+
+// Open starts listening on the given address.
+func (r *RelayServer) Open(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	if r.Expire == 0 {
+		r.Expire = 30 * time.Second
+	}
+	if r.MaxSessions == 0 {
+		r.MaxSessions = 32
+	}
+	r.conns = []net.PacketConn{conn}
+	r.sessions = make(map[uint64]*relaySession)
+	r.members = make(map[string]relayRoute)
+	r.lastStats = time.Now()
+	return nil
+}
+
+// LocalAddr returns the address the relay is listening on for UDP.
+func (r *RelayServer) LocalAddr() net.Addr {
+	return r.conns[0].LocalAddr()
+}
+
+// Run forwards traffic until the relay is closed.
+func (r *RelayServer) Run() error {
+	packets := make(chan relayPacket, NetChannelSize)
+	errs := make(chan error, len(r.conns))
+	for _, conn := range r.conns {
+		go r.read(conn, packets, errs)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case packet := <-packets:
+			if isControlPacket(packet.b) {
+				r.handleControl(packet.b[len(controlMagic):], packet.addr, packet.conn)
+			} else if len(packet.b) >= relayHeaderSize {
+				r.forward(packet.b, packet.addr)
+			}
+		case <-ticker.C:
+			r.expire()
+			if r.StatsInterval > 0 && time.Since(r.lastStats) > r.StatsInterval {
+				r.logStats()
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (r *RelayServer) read(conn net.PacketConn, packets chan relayPacket, errs chan error) {
+	buffer := make([]byte, NetBufferSize+relayHeaderSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			errs <- err
+			return
+		}
+		packets <- relayPacket{
+			b:    append([]byte(nil), buffer[:n]...),
+			addr: addr,
+			conn: conn,
+		}
+	}
+}
+
+// Close stops the relay.
+func (r *RelayServer) Close() error {
+	var err error
+	for _, conn := range r.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (r *RelayServer) expire() {
+	for id, session := range r.sessions {
+		if time.Since(session.seen) > r.Expire {
+			fmt.Printf("session %016x expired: %s\n", id, session.stats())
+			r.removeSession(session)
+		}
+	}
+}
+
+func (r *RelayServer) removeSession(session *relaySession) {
+	for _, m := range session.members {
+		if m.addr == nil {
+			continue
+		}
+		if route, ok := r.members[m.addr.String()]; ok && route.session == session.id {
+			delete(r.members, m.addr.String())
+		}
+	}
+	delete(r.sessions, session.id)
+}
+
+func (r *RelayServer) logStats() {
+	r.lastStats = time.Now()
+	if len(r.sessions) == 0 {
+		return
+	}
+	fmt.Printf("%d/%d sessions\n", len(r.sessions), r.MaxSessions)
+	for id, session := range r.sessions {
+		fmt.Printf("session %016x: %s\n", id, session.stats())
+	}
+}
+
+func (s *relaySession) stats() string {
+	var members int
+	for _, m := range s.members {
+		if m.addr != nil {
+			members++
+		}
+	}
+	return fmt.Sprintf("%d members, %d packets, %d bytes, %d dropped, up %s", members, s.packets, s.bytes, s.dropped, time.Since(s.created).Round(time.Second))
+}
+
+func (r *RelayServer) sendControl(kind uint8, addr net.Addr, conn net.PacketConn, payload ...byte) {
+	b := make([]byte, 0, len(controlMagic)+1+len(payload))
+	b = append(b, controlMagic...)
+	b = append(b, kind)
+	b = append(b, payload...)
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (r *RelayServer) sendError(session uint64, reason string, addr net.Addr, conn net.PacketConn) {
+	payload := binary.LittleEndian.AppendUint64(nil, session)
+	payload = AppendString(payload, reason)
+	r.sendControl(controlRelayError, addr, conn, payload...)
+}
+
+func (r *RelayServer) handleControl(b []byte, addr net.Addr, conn net.PacketConn) {
+	if b[0] != controlRelayJoin || len(b) < 10 {
+		return
+	}
+	id := binary.LittleEndian.Uint64(b[1:])
+	host := b[9] == 1
+	var secret uint64
+	if host {
+		if len(b) < 18 {
+			return
+		}
+		secret = binary.LittleEndian.Uint64(b[10:])
+	}
+
+	session, ok := r.sessions[id]
+	if !ok {
+		if len(r.sessions) >= r.MaxSessions {
+			logPacket("session %016x refused for %s: %s", id, addr, RelayReasonFull)
+			r.sendError(id, RelayReasonFull, addr, conn)
+			return
+		}
+		session = &relaySession{
+			id:      id,
+			members: make([]relayMember, 1, RelayMaxMembers),
+			created: time.Now(),
+		}
+		r.sessions[id] = session
+		fmt.Printf("session %016x opened by %s\n", id, addr)
+	}
+
+	// Find where the sender belongs in the session, if it isn't already in it.
+	member := -1
+	if host {
+		// The host's place is bound to the first to take it. Anyone else has to know its secret.
+		if old := session.members[0].addr; old == nil && session.secret == 0 {
+			session.secret = secret
+		} else if (old == nil || old.String() != addr.String()) && secret != session.secret {
+			logPacket("session %016x refused host %s: %s", id, addr, RelayReasonHostTaken)
+			r.sendError(id, RelayReasonHostTaken, addr, conn)
+			return
+		}
+		member = 0
+	} else {
+		for i, m := range session.members {
+			if i > 0 && m.addr != nil && m.addr.String() == addr.String() {
+				member = i
+				break
+			}
+		}
+		if member == -1 {
+			if len(session.members) >= RelayMaxMembers {
+				r.sendError(id, RelayReasonSessionFull, addr, conn)
+				return
+			}
+			member = len(session.members)
+			session.members = append(session.members, relayMember{})
+		}
+	}
+	if old := session.members[member].addr; old == nil || old.String() != addr.String() {
+		if old != nil {
+			delete(r.members, old.String())
+		}
+		fmt.Printf("session %016x: member %d is %s\n", id, member, addr)
+	}
+	session.members[member] = relayMember{addr: addr, conn: conn}
+	session.seen = time.Now()
+	r.members[addr.String()] = relayRoute{session: id, member: uint8(member)}
+
+	payload := binary.LittleEndian.AppendUint64(nil, id)
+	payload = append(payload, uint8(member))
+	r.sendControl(controlRelayJoined, addr, conn, payload...)
+}
+
+// forward passes a datagram from one member of a session to another.
+func (r *RelayServer) forward(b []byte, addr net.Addr) {
+	from, ok := r.members[addr.String()]
+	if !ok || binary.LittleEndian.Uint64(b) != from.session {
+		return
+	}
+	session, ok := r.sessions[from.session]
+	if !ok {
+		return
+	}
+	to := 0
+	if from.member == 0 {
+		to = int(b[8])
+	}
+	if to == int(from.member) || to >= len(session.members) || session.members[to].addr == nil {
+		session.dropped++
+		return
+	}
+	b[8] = from.member
+	if _, err := session.members[to].conn.WriteTo(b, session.members[to].addr); err != nil {
+		session.dropped++
+		return
+	}
+	session.seen = time.Now()
+	session.packets++
+	session.bytes += uint64(len(b) - relayHeaderSize)
+}
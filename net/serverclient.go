@@ -1,11 +1,15 @@
 package net
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xtaci/kcp-go"
@@ -15,60 +19,131 @@ var NetDataShards = 10
 var NetParityShards = 3
 var NetBufferSize = 2048
 var NetChannelSize = 10
+var NetMatchmakerAddress = "gamu.group:20220"
+var NetMatchmakerRefresh = 2 * time.Second
+var NetHeartbeatInterval = 1 * time.Second
+var NetTimeout = 10 * time.Second
+
+// NetSpectatorWriteTimeout is how long sending to a spectator may block before the data is dropped.
+var NetSpectatorWriteTimeout = 50 * time.Millisecond
 
 type ServerClient struct {
-	id uint32 // Our ID used to advertise to others.
+	id    uint32 // Our ID used to advertise to others.
+	token uint64 // Our session token, used to resume with peers after reconnecting.
 	//
 	Matchmaker     string
-	matchmakerAddr *net.UDPAddr
+	matchmakerAddr net.Addr
 	UseMatchmaker  bool
+	Relay          string // Relay to fall back to when we cannot reach the other side directly.
+	relayConn      *relayConn
+	relaySession   uint64 // Relay session we are hosting or joining, if any.
+	relaySecret    uint64 // Proves to the relay that we are the host of our session.
+	lobby          string // Lobby name we are registered as or are looking up.
 	Hosting        bool
+	Spectating     bool            // Set to join without any players, only watching the game.
+	MigrateHost    bool            // Set to elect a new host if ours leaves, rather than being left without one.
+	members        *MessageMembers // Who our host last told us it is hosting.
+	oldHost        string          // Address of a host that has left, so that its stragglers are not taken for a new peer.
+	Passphrase     string          // Passphrase the session key is derived from. Must match between peers.
+	key            []byte
+	controlKey     []byte         // Signs the control packets that act on a peer.
+	check          kcp.BlockCrypt // Only used by LogicLoop to check packets from unverified peers.
 	Running        bool
-	localAddr      *net.UDPAddr
-	localConn      *net.UDPConn
+	Transport      Transport // What we send our datagrams over.
+	localConn      net.PacketConn
+	WrapConn       func(conn net.PacketConn) net.PacketConn // Optionally wraps the conn Open listens on, such as with a LossyConn.
 	closeChan      chan struct{}
+	closing        bool          // Set once we have been told to close, until we are opened again.
+	stopped        chan struct{} // Closed once LogicLoop has finished closing.
 	rawChan        chan Packet
 	peerChan       chan PeerPacket
+	reconnectChan  chan *Peer
 	EventChan      chan Event
 	peers          []*Peer
+	peersLock      sync.Mutex
+	punches        map[string]*punch
+	reconnecting   map[uint64]*Peer // Peers we are waiting to resume with, by their session token.
+	redial         *redial
+	advert         atomic.Value // *advertInfo broadcast to the LAN while hosting.
 }
 
 func (s *ServerClient) Init() {
 	s.id = uint32(rand.Int31())
-	s.closeChan = make(chan struct{})
+	// Anyone who can guess our token can take over our sessions, so it must not be predictable.
+	var token [8]byte
+	if _, err := crand.Read(token[:]); err != nil {
+		panic(err)
+	}
+	s.token = binary.LittleEndian.Uint64(token[:])
+	if _, err := crand.Read(token[:]); err != nil {
+		panic(err)
+	}
+	s.relaySecret = binary.LittleEndian.Uint64(token[:])
+	s.closeChan = make(chan struct{}, 1)
 	s.rawChan = make(chan Packet, NetChannelSize*2)
 	s.peerChan = make(chan PeerPacket, NetChannelSize)
+	s.reconnectChan = make(chan *Peer, NetChannelSize)
 	s.EventChan = make(chan Event, NetChannelSize)
-	s.Matchmaker = "gamu.group:20220"
+	s.Matchmaker = NetMatchmakerAddress
+	s.Relay = NetRelayAddress
+	s.Transport = NetTransport
 }
 
 func (s *ServerClient) ID() uint32 {
 	return s.id
 }
 
+// LocalAddr returns the address we are listening on.
+func (s *ServerClient) LocalAddr() net.Addr {
+	return s.localConn.LocalAddr()
+}
+
 func (s *ServerClient) Open(address string) error {
-	// Set up our matchmaker address.
-	matchMakerAddr, err := net.ResolveUDPAddr("udp", s.Matchmaker)
-	if err == nil {
-		s.matchmakerAddr = matchMakerAddr
-	} else {
-		fmt.Println("matchmaker's address is bad", err)
+	// Let the last session finish closing first.
+	if s.closing {
+		<-s.stopped
+		s.closing = false
 	}
 
-	// Get our UDP address.
-	addr, err := net.ResolveUDPAddr("udp", address)
-	if err != nil {
-		return err
+	// Set up our matchmaker address, if we can reach it.
+	s.matchmakerAddr = nil
+	if s.Transport.Direct() {
+		matchMakerAddr, err := s.Transport.ResolveAddr(s.Matchmaker)
+		if err == nil {
+			s.matchmakerAddr = matchMakerAddr
+		} else {
+			fmt.Println("matchmaker's address is bad", err)
+		}
 	}
 
-	// Open our UDP connection.
-	conn, err := net.ListenUDP("udp", addr)
+	// Open our connection.
+	conn, err := s.Transport.Listen(address)
 	if err != nil {
 		return err
 	}
 
-	s.localAddr = addr
-	s.localConn = conn
+	// Set up our relay address, if we have one.
+	var relayAddr net.Addr
+	if s.Relay != "" {
+		if relayAddr, err = s.Transport.ResolveAddr(s.Relay); err != nil {
+			fmt.Println("relay's address is bad", err)
+		}
+	}
+
+	s.setPassphrase(s.Passphrase)
+	s.relayConn = newRelayConn(conn, relayAddr)
+	s.relaySession = 0
+	if s.WrapConn != nil {
+		s.localConn = s.WrapConn(s.relayConn)
+	} else {
+		s.localConn = s.relayConn
+	}
+	s.punches = make(map[string]*punch)
+	s.reconnecting = make(map[uint64]*Peer)
+	s.redial = nil
+	s.members = nil
+	s.oldHost = ""
+	s.stopped = make(chan struct{})
 	s.Running = true
 
 	fmt.Println("...now listening on", conn.LocalAddr().String())
@@ -85,14 +160,14 @@ func (s *ServerClient) ConnectTo(address string) error {
 	if address != "" && address[0] == ':' {
 		address = "127.0.0.1" + address
 	}
-	addr, err := net.ResolveUDPAddr("udp", address)
+	addr, err := s.Transport.ResolveAddr(address)
 	if err != nil {
 		return err
 	}
 	peer := NewPeer(addr, s.localConn)
-	s.peers = append(s.peers, peer)
+	s.addPeer(peer)
 
-	session, err := kcp.NewConn3(0, addr, nil, NetDataShards, NetParityShards, peer)
+	session, err := kcp.NewConn3(0, addr, s.newCrypt(), NetDataShards, NetParityShards, peer)
 	if err != nil {
 		panic(err)
 	}
@@ -101,47 +176,136 @@ func (s *ServerClient) ConnectTo(address string) error {
 
 	s.EventChan <- EventJoining{}
 
-	peer.Send(MessageID{ID: s.id})
+	peer.Send(s.hello())
 
 	return nil
 }
 
 type Packet struct {
 	buffer    []byte
-	addr      *net.UDPAddr
+	addr      net.Addr
 	readBytes int
 }
 
 // LogicLoop is the main logic loop that handles raw packets and otherwise.
 func (s *ServerClient) LogicLoop() {
+	refresh := time.NewTicker(NetMatchmakerRefresh)
+	defer refresh.Stop()
+	punchRefresh := time.NewTicker(NetPunchInterval)
+	defer punchRefresh.Stop()
+	heartbeat := time.NewTicker(NetHeartbeatInterval)
+	defer heartbeat.Stop()
+	advertise := time.NewTicker(NetDiscoveryInterval)
+	defer advertise.Stop()
 	for s.Running {
 		select {
-		case <-s.closeChan:
-			for _, p := range s.peers {
-				p.session.Close()
+		case <-heartbeat.C:
+			s.checkPeers()
+			s.pingPeers()
+		case peer := <-s.reconnectChan:
+			s.reconnect(peer)
+		case <-punchRefresh.C:
+			s.refreshPunches()
+			s.refreshRedial()
+		case <-advertise.C:
+			s.advertise()
+		case <-refresh.C:
+			// Keep our lobby alive, or retry our lookup.
+			if s.lobby != "" {
+				if s.Hosting {
+					s.sendToMatchmaker(MatchmakerRegister{Lobby: s.lobby})
+				} else if len(s.Peers()) == 0 && len(s.punches) == 0 && len(s.reconnecting) == 0 {
+					s.sendToMatchmaker(MatchmakerLookup{Lobby: s.lobby})
+				}
 			}
-			s.localConn.Close()
-			s.Running = false
-			s.EventChan <- EventClosed{}
+			s.refreshRelay()
+		case <-s.closeChan:
+			s.shutdown()
 			return
 		case msg := <-s.peerChan:
-			switch msg.msg.(type) {
+			if msg.drop != "" {
+				s.dropPeer(msg.peer, msg.drop)
+				continue
+			}
+			msg.peer.lastReceived.Store(time.Now().UnixNano())
+			msg.peer.reported.Store(false)
+			if msg.peer.timedOut.Swap(false) {
+				fmt.Println("peer", msg.peer.addr, "resumed")
+				s.EventChan <- EventResumed{
+					Peer: msg.peer,
+					ID:   msg.peer.id,
+				}
+			}
+			if msg.peer.rejected.Load() {
+				if _, ok := msg.msg.(MessageClose); ok {
+					s.removePeer(msg.peer)
+				}
+				continue
+			}
+			switch m := msg.msg.(type) {
 			case MessageID:
+				if reason := s.checkHello(m); reason != "" {
+					s.Reject(msg.peer, reason)
+					s.EventChan <- EventRejected{
+						Peer:   msg.peer,
+						ID:     m.ID,
+						Reason: reason,
+					}
+					continue
+				}
+				if old, ok := s.reconnecting[m.Token]; ok && old.id == m.ID {
+					delete(s.reconnecting, m.Token)
+					msg.peer.id = m.ID
+					msg.peer.token = m.Token
+					msg.peer.spectator.Store(m.Spectator)
+					fmt.Println("resumed with peer", m.ID, "at", msg.peer.addr)
+					s.EventChan <- EventReconnect{
+						ID:      m.ID,
+						Peer:    msg.peer,
+						OldPeer: old,
+					}
+					s.syncMembers()
+					continue
+				}
 				if msg.peer.id == 0 {
 					if !s.Hosting {
 						s.EventChan <- EventJoined{}
 					}
 				}
-				msg.peer.id = msg.msg.(MessageID).ID
+				msg.peer.id = m.ID
+				msg.peer.token = m.Token
+				msg.peer.spectator.Store(m.Spectator)
 				s.EventChan <- EventConnect{
 					Peer: msg.peer,
 					ID:   msg.peer.id,
 				}
+				s.syncMembers()
+			case MessageHeartbeat:
+				// Only needed to keep the peer alive.
+			case MessageMembers:
+				if !s.Hosting {
+					s.members = &m
+				}
+			case MessageReject:
+				msg.peer.rejected.Store(true)
+				s.EventChan <- EventRejected{
+					Peer:   msg.peer,
+					ID:     msg.peer.id,
+					Reason: m.Reason,
+				}
 			case MessageClose:
+				msg.peer.left = true
 				s.EventChan <- EventDisconnect{
 					Peer: msg.peer,
 					ID:   msg.peer.id,
 				}
+				// Nothing waits on a spectator, so there is no reason to keep it around.
+				if msg.peer.Spectator() {
+					s.removePeer(msg.peer)
+				} else if s.canMigrate() {
+					s.migrate(msg.peer)
+				}
+				s.syncMembers()
 			default:
 				s.EventChan <- EventMessage{
 					Peer:    msg.peer,
@@ -152,22 +316,32 @@ func (s *ServerClient) LogicLoop() {
 			//fmt.Println("got raw packet", packet)
 			// If the packet is from the matchmaker, handle it.
 			if s.matchmakerAddr != nil && packet.addr.String() == s.matchmakerAddr.String() {
-				fmt.Println("handling as matchmaker")
-				// TODO: Handle matchmaker packets.
-				return
+				s.handleMatchmakerPacket(packet)
+				continue
+			}
+			// Control packets never belong to a KCP session.
+			if isControlPacket(packet.buffer[:packet.readBytes]) {
+				s.handleControlPacket(packet)
+				continue
 			}
 			// If we've never received from this address before, add it to our list of peers.
-			var peer *Peer
-			for _, p := range s.peers {
-				if p.addr.String() == packet.addr.String() {
-					peer = p
-					break
+			peer := s.peerByAddr(packet.addr.String())
+			// Whatever a host that has left still had in flight is of no use to anyone.
+			if peer == nil && packet.addr.String() == s.oldHost {
+				continue
+			}
+			// Check packets from unverified peers ourselves, so we can tell them why we won't talk.
+			if peer == nil || !peer.verified {
+				if !s.validPacket(packet.buffer[:packet.readBytes]) {
+					s.rejectPassphrase(packet.addr)
+					continue
 				}
 			}
 			if peer == nil {
 				peer = NewPeer(packet.addr, s.localConn)
-				s.peers = append(s.peers, peer)
+				s.addPeer(peer)
 			}
+			peer.verified = true
 
 			if packet.readBytes > 0 {
 				peer.writeToPacketBuffer(packet.buffer[:packet.readBytes])
@@ -175,17 +349,14 @@ func (s *ServerClient) LogicLoop() {
 
 			// Session is nil, try to set up a kcp session.
 			if peer.session == nil {
-				session, err := kcp.NewConn3(0, packet.addr, nil, NetDataShards, NetParityShards, peer)
+				session, err := kcp.NewConn3(0, packet.addr, s.newCrypt(), NetDataShards, NetParityShards, peer)
 				if err != nil {
 					panic(err)
 				}
 				peer.session = session
 				go peer.loop(s.peerChan)
 
-				peer.Send(MessageID{ID: s.id})
-			} else {
-				// Send packet data to peer's virtual buffer.
-				peer.writeToPacketBuffer(packet.buffer[:packet.readBytes])
+				peer.Send(s.hello())
 			}
 		}
 	}
@@ -195,7 +366,7 @@ func (s *ServerClient) LogicLoop() {
 func (s *ServerClient) ReadLoop() {
 	for s.Running {
 		buffer := make([]byte, NetBufferSize)
-		n, addr, err := s.localConn.ReadFromUDP(buffer)
+		n, addr, err := s.localConn.ReadFrom(buffer)
 		if err != nil {
 			if !os.IsTimeout(err) {
 				if !(strings.HasSuffix(err.Error(), "closed network connection")) {
@@ -213,21 +384,162 @@ func (s *ServerClient) ReadLoop() {
 	}
 }
 
+// Close tells LogicLoop to close without waiting for it.
 func (s *ServerClient) Close() {
-	if !s.Running {
+	if !s.Running || s.closing {
 		return
 	}
-	for _, peer := range s.peers {
-		peer.Send(MessageClose{})
+	s.closing = true
+	s.closeChan <- struct{}{}
+}
+
+// shutdown says goodbye to our peers and closes everything. Only LogicLoop calls it.
+func (s *ServerClient) shutdown() {
+	if s.Hosting && s.lobby != "" {
+		s.sendToMatchmaker(MatchmakerUnregister{Lobby: s.lobby})
+	}
+	s.peersLock.Lock()
+	peers := s.peers
+	s.peers = nil
+	s.peersLock.Unlock()
+	for _, p := range peers {
+		p.trySend(MessageClose{})
+	}
+	// Give the goodbyes a moment to get out.
+	time.Sleep(time.Second)
+	for _, p := range peers {
+		if p.session != nil {
+			p.session.Close()
+		}
+		p.Close()
+	}
+	s.localConn.Close()
+	s.Running = false
+	s.lobby = ""
+	close(s.stopped)
+
+	for _, p := range peers {
 		s.EventChan <- EventDisconnect{
-			Peer: peer,
-			ID:   peer.id,
+			Peer: p,
+			ID:   p.id,
+		}
+	}
+	s.EventChan <- EventClosed{}
+}
+
+// checkPeers sends heartbeats and lets us know of any peers that have gone quiet.
+func (s *ServerClient) checkPeers() {
+	var lostHost *Peer
+	for _, p := range s.Peers() {
+		if p.session == nil || p.rejected.Load() {
+			continue
+		}
+		p.Heartbeat()
+		if p.Idle() > NetTimeout {
+			p.timedOut.Store(true)
+			if p.reported.Swap(true) {
+				continue
+			}
+			fmt.Println("peer", p.addr, "timed out")
+			if s.canMigrate() {
+				lostHost = p
+				continue
+			}
+			s.EventChan <- EventTimeout{
+				Peer: p,
+				ID:   p.id,
+			}
+		}
+	}
+	if lostHost != nil {
+		s.migrate(lostHost)
+	}
+}
+
+// canMigrate returns whether we would elect a new host should ours be lost.
+func (s *ServerClient) canMigrate() bool {
+	return !s.Hosting && s.MigrateHost && s.members != nil
+}
+
+// Reject refuses to play with the given peer, letting them know why.
+func (s *ServerClient) Reject(peer *Peer, reason string) {
+	fmt.Println("rejecting peer", peer.addr, reason)
+	peer.Send(MessageReject{Reason: reason})
+	peer.rejected.Store(true)
+}
+
+// hello returns the MessageID we introduce ourselves to peers with.
+func (s *ServerClient) hello() MessageID {
+	return MessageID{
+		ID:          s.id,
+		Version:     NetProtocolVersion,
+		Fingerprint: NetFingerprint,
+		Token:       s.token,
+		Spectator:   s.Spectating,
+	}
+}
+
+// checkHello returns the reason we cannot play with the sender of the given MessageID, if any.
+func (s *ServerClient) checkHello(m MessageID) string {
+	if m.Version != NetProtocolVersion {
+		return RejectReasonVersion
+	}
+	if m.Fingerprint != NetFingerprint {
+		return RejectReasonAssets
+	}
+	return ""
+}
+
+// dropPeer rejects and forgets a peer that can no longer be read from.
+func (s *ServerClient) dropPeer(peer *Peer, reason string) {
+	if !peer.rejected.Load() {
+		s.Reject(peer, reason)
+		s.EventChan <- EventRejected{
+			Peer:   peer,
+			ID:     peer.id,
+			Reason: reason,
+		}
+	}
+	s.removePeer(peer)
+}
+
+func (s *ServerClient) addPeer(peer *Peer) {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	s.peers = append(s.peers, peer)
+}
+
+// peerByAddr returns the peer at the given address, if any.
+func (s *ServerClient) peerByAddr(addr string) *Peer {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	for _, p := range s.peers {
+		if p.addr.String() == addr {
+			return p
+		}
+	}
+	return nil
+}
+
+// removePeer closes and forgets the given peer.
+func (s *ServerClient) removePeer(peer *Peer) {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	for i, p := range s.peers {
+		if p == peer {
+			if p.session != nil {
+				p.session.Close()
+			}
+			p.Close()
+			s.peers = append(s.peers[:i], s.peers[i+1:]...)
+			return
 		}
 	}
-	<-time.After(1 * time.Second)
-	s.closeChan <- struct{}{}
 }
 
+// Peers returns a copy of our peers, as they may be added or removed at any time.
 func (s *ServerClient) Peers() []*Peer {
-	return s.peers
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	return append([]*Peer(nil), s.peers...)
 }
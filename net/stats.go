@@ -0,0 +1,132 @@
+package net
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// pingWindow is how many of the most recent pings loss is measured over.
+const pingWindow = 32
+
+// PeerStats is a snapshot of how our connection to a peer is doing.
+type PeerStats struct {
+	RTT     time.Duration // Smoothed round trip time.
+	Loss    float64       // Fraction of recent pings that went unanswered.
+	InRate  float64       // Bytes per second received, including KCP's own overhead.
+	OutRate float64       // Bytes per second sent, including KCP's own overhead.
+}
+
+// peerStats collects what goes into PeerStats.
+type peerStats struct {
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	lock     sync.Mutex
+	pingSeq  uint32 // Sequence of the last ping sent.
+	pongs    uint32 // Bit i is set if ping pingSeq-i was answered.
+	pinged   int    // Pings sent, up to pingWindow.
+	sampled  time.Time
+	lastIn   uint64
+	lastOut  uint64
+	current  PeerStats
+}
+
+// Stats returns how our connection to the peer is doing, as of the last heartbeat.
+func (p *Peer) Stats() PeerStats {
+	p.stats.lock.Lock()
+	defer p.stats.lock.Unlock()
+	return p.stats.current
+}
+
+// sample updates the byte rates and starts the next ping, returning its sequence.
+func (st *peerStats) sample() uint32 {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	now := time.Now()
+	in, out := st.bytesIn.Load(), st.bytesOut.Load()
+	if !st.sampled.IsZero() {
+		elapsed := now.Sub(st.sampled).Seconds()
+		st.current.InRate = float64(in-st.lastIn) / elapsed
+		st.current.OutRate = float64(out-st.lastOut) / elapsed
+	}
+	st.sampled, st.lastIn, st.lastOut = now, in, out
+
+	// The ping about to be sent can't have been answered yet, so only count the ones before it.
+	if st.pinged > 0 {
+		answered := bits.OnesCount32(st.pongs)
+		st.current.Loss = 1 - float64(answered)/float64(st.pinged)
+	}
+	st.pingSeq++
+	st.pongs <<= 1
+	if st.pinged < pingWindow {
+		st.pinged++
+	}
+	return st.pingSeq
+}
+
+// pong records the answer to one of our pings.
+func (st *peerStats) pong(seq uint32, sent time.Time) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	age := st.pingSeq - seq
+	if age >= pingWindow {
+		return
+	}
+	st.pongs |= 1 << age
+	rtt := time.Since(sent)
+	if st.current.RTT == 0 {
+		st.current.RTT = rtt
+	} else {
+		st.current.RTT += (rtt - st.current.RTT) / 8
+	}
+}
+
+// KCPStats is how KCP is doing across every peer, as it does not keep count per peer.
+type KCPStats struct {
+	Retransmits uint64 // Segments sent again, for any reason.
+	Lost        uint64 // Segments KCP decided were lost.
+}
+
+// GetKCPStats returns KCP's counters since we started.
+func GetKCPStats() KCPStats {
+	snmp := kcp.DefaultSnmp.Copy()
+	return KCPStats{
+		Retransmits: snmp.RetransSegs + snmp.FastRetransSegs + snmp.EarlyRetransSegs,
+		Lost:        snmp.LostSegs,
+	}
+}
+
+// pingPeers samples the stats of every peer and pings it.
+func (s *ServerClient) pingPeers() {
+	for _, p := range s.Peers() {
+		if p.session == nil || p.rejected.Load() {
+			continue
+		}
+		seq := p.stats.sample()
+		payload := binary.LittleEndian.AppendUint32(nil, seq)
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(time.Now().UnixNano()))
+		s.sendControl(controlPing, p.addr, payload...)
+	}
+}
+
+// handlePing answers a peer's ping, or records the answer to ours.
+func (s *ServerClient) handlePing(kind uint8, payload []byte, addr net.Addr) {
+	if len(payload) < 12 {
+		return
+	}
+	if kind == controlPing {
+		s.sendControl(controlPong, addr, payload[:12]...)
+		return
+	}
+	for _, p := range s.Peers() {
+		if p.addr.String() == addr.String() {
+			p.stats.pong(binary.LittleEndian.Uint32(payload), time.Unix(0, int64(binary.LittleEndian.Uint64(payload[4:]))))
+			return
+		}
+	}
+}
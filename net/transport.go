@@ -0,0 +1,90 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ErrUnreachable = errors.New("only the relay can be reached over this transport")
+)
+
+// Transport is what a ServerClient sends its datagrams over.
+type Transport interface {
+	// Listen opens the conn datagrams are sent and received on.
+	Listen(address string) (net.PacketConn, error)
+	// ResolveAddr turns an address into one the conn can send to.
+	ResolveAddr(address string) (net.Addr, error)
+	// Direct returns whether anything can be reached without the relay.
+	Direct() bool
+}
+
+// NetTransport is the transport ServerClients use unless told otherwise.
+var NetTransport Transport = UDPTransport{}
+
+// UDPTransport sends datagrams over UDP.
+type UDPTransport struct{}
+
+func (t UDPTransport) Listen(address string) (net.PacketConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+func (t UDPTransport) ResolveAddr(address string) (net.Addr, error) {
+	return net.ResolveUDPAddr("udp", address)
+}
+
+func (t UDPTransport) Direct() bool {
+	return true
+}
+
+// WebSocketTransport sends datagrams over a WebSocket to the relay, for browsers.
+type WebSocketTransport struct {
+	URL string // URL of the relay's WebSocket. NetRelayAddress is used if empty.
+}
+
+func (t WebSocketTransport) url() string {
+	if t.URL != "" {
+		return t.URL
+	}
+	return NetRelayAddress
+}
+
+// Listen connects to the relay. There is nothing to listen on, so the address is ignored.
+func (t WebSocketTransport) Listen(address string) (net.PacketConn, error) {
+	url := t.url()
+	if url == "" {
+		return nil, ErrNoRelay
+	}
+	return dialWebSocket(url)
+}
+
+// ResolveAddr resolves the relay's URL as itself, and anything else as a peer behind it.
+func (t WebSocketTransport) ResolveAddr(address string) (net.Addr, error) {
+	if strings.Contains(address, "://") {
+		return wsAddr(address), nil
+	}
+	return net.ResolveUDPAddr("udp", address)
+}
+
+func (t WebSocketTransport) Direct() bool {
+	return false
+}
+
+// WebSocketPath is where the relay accepts WebSockets.
+const WebSocketPath = "/relay"
+
+// wsAddr is the address of the other end of a WebSocket.
+type wsAddr string
+
+func (a wsAddr) Network() string {
+	return "ws"
+}
+
+func (a wsAddr) String() string {
+	return string(a)
+}
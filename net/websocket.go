@@ -0,0 +1,179 @@
+//go:build !js
+
+package net
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn is our end of a WebSocket to the relay.
+type wsConn struct {
+	ws   *websocket.Conn
+	addr wsAddr
+}
+
+func dialWebSocket(url string) (net.PacketConn, error) {
+	ws, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{ws: ws, addr: wsAddr(url)}, nil
+}
+
+func (c *wsConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(c.ws, &msg); err != nil {
+		return 0, c.addr, err
+	}
+	return copy(b, msg), c.addr, nil
+}
+
+func (c *wsConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr.String() != c.addr.String() {
+		return 0, ErrUnreachable
+	}
+	if err := websocket.Message.Send(c.ws, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	return c.ws.SetDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// wsListener accepts WebSockets and makes them look like a single PacketConn.
+type wsListener struct {
+	listener net.Listener
+	packets  chan wsPacket
+	lock     sync.Mutex
+	clients  map[string]*websocket.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+type wsPacket struct {
+	b    []byte
+	addr wsAddr
+}
+
+// listenWebSocket accepts WebSockets on WebSocketPath. Anything else is left to static, if given.
+func listenWebSocket(address string, static http.Handler) (*wsListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &wsListener{
+		listener: listener,
+		packets:  make(chan wsPacket, NetChannelSize),
+		clients:  make(map[string]*websocket.Conn),
+		done:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, websocket.Handler(l.serve))
+	if static != nil {
+		mux.Handle("/", static)
+	}
+	go http.Serve(listener, mux)
+	return l, nil
+}
+
+func (l *wsListener) serve(ws *websocket.Conn) {
+	addr := wsAddr("ws://" + ws.Request().RemoteAddr)
+	l.lock.Lock()
+	l.clients[addr.String()] = ws
+	l.lock.Unlock()
+	defer func() {
+		l.lock.Lock()
+		delete(l.clients, addr.String())
+		l.lock.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return
+		}
+		select {
+		case l.packets <- wsPacket{b: msg, addr: addr}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *wsListener) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-l.packets:
+		return copy(b, packet.b), packet.addr, nil
+	case <-l.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.lock.Lock()
+	ws, ok := l.clients[addr.String()]
+	l.lock.Unlock()
+	if !ok {
+		return 0, ErrUnreachable
+	}
+	if err := websocket.Message.Send(ws, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.listener.Close()
+		l.lock.Lock()
+		for _, ws := range l.clients {
+			ws.Close()
+		}
+		l.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *wsListener) LocalAddr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Deadlines are not supported, as the relay has no need for them.
+func (l *wsListener) SetDeadline(t time.Time) error      { return nil }
+func (l *wsListener) SetReadDeadline(t time.Time) error  { return nil }
+func (l *wsListener) SetWriteDeadline(t time.Time) error { return nil }
+
+// ListenWebSocket lets players reach the relay over WebSockets, optionally serving static too.
+func (r *RelayServer) ListenWebSocket(address string, static http.Handler) error {
+	l, err := listenWebSocket(address, static)
+	if err != nil {
+		return err
+	}
+	r.conns = append(r.conns, l)
+	return nil
+}
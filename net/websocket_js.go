@@ -0,0 +1,127 @@
+//go:build js
+
+package net
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+func init() {
+	// Browsers can only use WebSockets, and are served by the relay, so that's where to find it.
+	NetTransport = WebSocketTransport{}
+	if NetRelayAddress == "" {
+		location := js.Global().Get("location")
+		scheme := "ws://"
+		if location.Get("protocol").String() == "https:" {
+			scheme = "wss://"
+		}
+		NetRelayAddress = scheme + location.Get("host").String() + WebSocketPath
+	}
+}
+
+// wsConn is our end of a WebSocket to the relay, using the browser's WebSocket.
+type wsConn struct {
+	ws      js.Value
+	addr    wsAddr
+	packets chan []byte
+	funcs   []js.Func
+	done    chan struct{}
+	once    sync.Once
+}
+
+func dialWebSocket(url string) (net.PacketConn, error) {
+	c := &wsConn{
+		ws:      js.Global().Get("WebSocket").New(url),
+		addr:    wsAddr(url),
+		packets: make(chan []byte, NetChannelSize),
+		done:    make(chan struct{}),
+	}
+	c.ws.Set("binaryType", "arraybuffer")
+
+	opened := make(chan error, 1)
+	c.on("open", func(js.Value) {
+		select {
+		case opened <- nil:
+		default:
+		}
+	})
+	c.on("close", func(js.Value) {
+		select {
+		case opened <- errors.New("could not connect to " + url):
+		default:
+		}
+		c.Close()
+	})
+	c.on("message", func(ev js.Value) {
+		data := js.Global().Get("Uint8Array").New(ev.Get("data"))
+		b := make([]byte, data.Get("length").Int())
+		js.CopyBytesToGo(b, data)
+		// Drop it if we are behind, just as UDP would.
+		select {
+		case c.packets <- b:
+		default:
+		}
+	})
+
+	if err := <-opened; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *wsConn) on(event string, fn func(js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		fn(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	c.ws.Call("addEventListener", event, f)
+}
+
+func (c *wsConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(b, packet), c.addr, nil
+	case <-c.done:
+		return 0, c.addr, net.ErrClosed
+	}
+}
+
+func (c *wsConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr.String() != c.addr.String() {
+		return 0, ErrUnreachable
+	}
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	data := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(data, b)
+	c.ws.Call("send", data)
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.ws.Call("close")
+		for _, f := range c.funcs {
+			f.Release()
+		}
+	})
+	return nil
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return wsAddr("browser")
+}
+
+// Deadlines are not supported, as the ServerClient has no need for them on its own conn.
+func (c *wsConn) SetDeadline(t time.Time) error      { return nil }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return nil }
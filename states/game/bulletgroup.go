@@ -2,6 +2,7 @@ package game
 
 import (
 	"math"
+	"math/rand"
 
 	"github.com/ketMix/retromancer/resources"
 )
@@ -24,9 +25,10 @@ type BulletGroup struct {
 	lastSpawnedAt int        // How long since spawn
 	bulletCount   int        // How many bullets to spawn
 	loopCount     int        // How many times to loop
+	rng           *rand.Rand // Where random angles are drawn from
 }
 
-func CreateBulletGroupFromDef(override, alias *resources.BulletGroup) *BulletGroup {
+func CreateBulletGroupFromDef(override, alias *resources.BulletGroup, rng *rand.Rand) *BulletGroup {
 	// Create a bullet group from a bullet group definition
 	// Use override values if they exist
 	// TODO: maybe have default values if properties aren't present in alias or override
@@ -75,6 +77,7 @@ func CreateBulletGroupFromDef(override, alias *resources.BulletGroup) *BulletGro
 		bulletCount:   bulletCount,
 		loopCount:     loopCount,
 		fixedAngle:    fixedAngle,
+		rng:           rng,
 	}
 }
 
@@ -108,7 +111,7 @@ func (bg *BulletGroup) Update() (actions []Action) {
 			case Random:
 				// TODO: Random angle
 				// Generate a random angle
-				angle = rng.Float64() * math.Pi / 180
+				angle = bg.rng.Float64() * math.Pi / 180
 			case Fixed:
 				// Use the fixed angle
 				angle = float64(bg.fixedAngle-90) * math.Pi / 180
@@ -0,0 +1,216 @@
+package game
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/ketMix/retromancer/net"
+	"github.com/ketMix/retromancer/resources"
+	"github.com/ketMix/retromancer/states"
+	"github.com/tinne26/etxt"
+)
+
+// ChatKey opens the chat box while in game.
+var ChatKey = ebiten.KeyT
+
+// ChatHoldDuration is how long a line of chat stays before fading out.
+var ChatHoldDuration = 8 * time.Second
+
+// chatLines is how many lines of chat are shown at once.
+const chatLines = 6
+
+// ChatMaxLength is the most characters a line of chat may have. Anything longer is cut short.
+const ChatMaxLength = 100
+
+// ChatText cuts a line of chat down to ChatMaxLength.
+func ChatText(text string) string {
+	if runes := []rune(text); len(runes) > ChatMaxLength {
+		return string(runes[:ChatMaxLength])
+	}
+	return text
+}
+
+func init() {
+	net.RegisterMessage(ChatMessage{})
+}
+
+// ChatMessage is a line of chat.
+type ChatMessage struct {
+	Name string
+	Text string
+}
+
+func (m ChatMessage) Ident() uint8 {
+	return 27
+}
+
+func (m ChatMessage) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = net.AppendString(b, m.Name)
+	b = net.AppendString(b, m.Text)
+	return
+}
+
+func (m ChatMessage) FromBytes(b []byte) (net.Message, int, error) {
+	offset := 1
+	name, n := net.ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+	text, n := net.ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+	m.Name = name
+	m.Text = text
+	return m, offset, nil
+}
+
+// Chat is a chat box along with the lines recently said above it.
+type Chat struct {
+	Input   resources.InputItem
+	lines   resources.VFXList
+	holding bool // Whether the key that closed the chat is still held.
+}
+
+// Init places the chat box. Lines of chat are stacked above it.
+func (c *Chat) Init(ctx states.Context, x, y, width float64) {
+	c.Input = resources.InputItem{
+		X:           x,
+		Y:           y,
+		Width:       width,
+		Placeholder: ctx.L.Get("Chat"),
+		Callback: func() bool {
+			return false
+		},
+	}
+}
+
+// Open starts typing into the chat box.
+func (c *Chat) Open() {
+	c.Input.Activate()
+}
+
+// Busy returns whether the keyboard belongs to the chat box.
+func (c *Chat) Busy() bool {
+	return c.Input.IsActive() || c.holding
+}
+
+// Update handles typing into the chat box, returning the line entered, if any.
+func (c *Chat) Update() (line string) {
+	if c.holding && !ebiten.IsKeyPressed(ebiten.KeyEnter) && !ebiten.IsKeyPressed(ebiten.KeyEscape) {
+		c.holding = false
+	}
+	if !c.Input.IsActive() {
+		return
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyEscape) {
+		c.Input.Deactivate()
+		c.Input.Text = ""
+	} else {
+		c.Input.Update()
+	}
+	if !c.Input.IsActive() {
+		line = strings.TrimSpace(c.Input.Text)
+		c.Input.Text = ""
+		c.holding = true
+	}
+	return
+}
+
+// Add shows a line of chat, pushing out the oldest if there are too many.
+func (c *Chat) Add(name, text string) {
+	if len(c.lines.Items()) >= chatLines {
+		c.lines.RemoveByID("text")
+	}
+	c.lines.Add(&resources.Text{
+		Text:         name + ": " + text,
+		Scale:        1.0,
+		Outline:      true,
+		OutlineColor: color.NRGBA{0x00, 0x00, 0x00, 0xff},
+		InDuration:   100 * time.Millisecond,
+		HoldDuration: ChatHoldDuration,
+		OutDuration:  2 * time.Second,
+	})
+}
+
+// Draw draws the lines of chat.
+func (c *Chat) Draw(ctx states.DrawContext) {
+	lineHeight := ctx.Text.Utils().GetLineHeight()
+	items := c.lines.Items()
+	for i, item := range items {
+		if t, ok := item.(*resources.Text); ok {
+			t.X = c.Input.X
+			t.Y = c.Input.Y - float64(len(items)-i)*lineHeight
+		}
+	}
+	ctx.Text.SetAlign(etxt.YCenter | etxt.XCenter)
+	c.lines.Process(ctx, nil)
+}
+
+// SendChat shows a line of chat from our players and sends it to our peers.
+func (s *World) SendChat(ctx states.Context, text string) {
+	msg := ChatMessage{Name: s.chatName(ctx), Text: ChatText(text)}
+	s.chat.Add(msg.Name, msg.Text)
+	for _, peer := range s.TickPeers() {
+		peer.Send(msg)
+	}
+}
+
+// HandleChat shows a line of chat from a peer, which the host passes on.
+func (s *World) HandleChat(ctx states.Context, peer *net.Peer, msg ChatMessage) {
+	msg.Text = ChatText(msg.Text)
+	if !s.Net.Hosting {
+		s.chat.Add(msg.Name, msg.Text)
+		return
+	}
+	msg.Name = ctx.L.Get("Spectator")
+	for i, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && remote.peer == peer {
+			msg.Name = fmt.Sprintf("P%d", i+1)
+			break
+		}
+	}
+	s.chat.Add(msg.Name, msg.Text)
+	for _, p := range s.TickPeers() {
+		if p != peer {
+			p.Send(msg)
+		}
+	}
+}
+
+// chatName is what our lines of chat are shown as, going by our first player's slot.
+func (s *World) chatName(ctx states.Context) string {
+	for i, player := range s.Players {
+		if _, ok := player.(*LocalPlayer); ok {
+			return fmt.Sprintf("P%d", i+1)
+		}
+	}
+	return ctx.L.Get("Spectator")
+}
+
+// updateChat handles the chat box. It returns whether the keyboard is in use by it.
+func (s *World) updateChat(ctx states.Context) bool {
+	if !s.Net.Running {
+		return false
+	}
+	if !s.chat.Input.IsActive() && inpututil.IsKeyJustPressed(ChatKey) {
+		s.chat.Open()
+	} else if line := s.chat.Update(); line != "" {
+		s.SendChat(ctx, line)
+	}
+	return s.chat.Busy()
+}
+
+func (s *World) drawChat(ctx states.DrawContext) {
+	s.chat.Draw(ctx)
+	if s.chat.Input.IsActive() {
+		s.chat.Input.Draw(ctx)
+	}
+}
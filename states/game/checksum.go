@@ -0,0 +1,295 @@
+package game
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/ketMix/retromancer/net"
+)
+
+// ChecksumInterval is how many ticks pass between world checksums being compared with our peers.
+var ChecksumInterval = 30
+
+// checksumsKept is how many of our own checksums are kept around for peers that lag behind.
+const checksumsKept = 4
+
+func init() {
+	net.RegisterMessage(WorldChecksum{})
+	net.RegisterMessage(DesyncState{})
+}
+
+// WorldChecksum is the hash of the world once Tick has been processed.
+type WorldChecksum struct {
+	Tick uint32
+	Sum  uint64
+}
+
+func (m WorldChecksum) Ident() uint8 {
+	return 25
+}
+
+func (m WorldChecksum) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = binary.LittleEndian.AppendUint32(b, m.Tick)
+	b = binary.LittleEndian.AppendUint64(b, m.Sum)
+	return
+}
+
+func (m WorldChecksum) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 13 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Tick = binary.LittleEndian.Uint32(b[1:])
+	m.Sum = binary.LittleEndian.Uint64(b[5:])
+	return m, 13, nil
+}
+
+// DesyncState carries the dump of a world whose checksum did not match.
+type DesyncState struct {
+	Tick uint32
+	Dump string
+}
+
+func (m DesyncState) Ident() uint8 {
+	return 26
+}
+
+func (m DesyncState) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = binary.LittleEndian.AppendUint32(b, m.Tick)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.Dump)))
+	b = append(b, m.Dump...)
+	return
+}
+
+func (m DesyncState) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 9 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Tick = binary.LittleEndian.Uint32(b[1:])
+	size := binary.LittleEndian.Uint32(b[5:])
+	if uint64(size) > uint64(len(b)-9) {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Dump = string(b[9 : 9+size])
+	return m, 9 + int(size), nil
+}
+
+// EventDesync is raised when a peer's world checksum differs from ours.
+type EventDesync struct {
+	Peer   *net.Peer
+	Tick   int
+	Local  uint64
+	Remote uint64
+}
+
+type localChecksum struct {
+	sum uint64
+}
+
+type remoteChecksum struct {
+	peer *net.Peer
+	tick int
+	sum  uint64
+}
+
+// DumpState describes what Checksum covers in a form that can be diffed.
+func (s *World) DumpState() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "tick %d\n", s.tick)
+	fmt.Fprintf(&sb, "rng %d %d\n", s.rng.state, s.rng.draws)
+	if s.activeMap == nil {
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, "map %s\n", s.activeMap.filename)
+	for i, a := range s.activeMap.actors {
+		x, y, w, h := a.Bounds()
+		fmt.Fprintf(&sb, "actor %d %T %v %v %v %v dead=%t destroyed=%t\n", i, a, x, y, w, h, a.Dead(), a.Destroyed())
+	}
+	for i, in := range s.activeMap.interactives {
+		fmt.Fprintf(&sb, "interactive %d %s active=%t activation=%d hp=%d\n", i, in.id, in.active, in.activationIdx, in.hp)
+	}
+	for i, b := range s.activeMap.bullets {
+		fmt.Fprintf(&sb, "bullet %d %v %v %v %v lifetime=%d reversed=%t deflected=%t destroyed=%t\n", i, b.Shape.X, b.Shape.Y, b.Angle, b.Speed, b.Lifetime, b.reversed, b.deflected, b.Destroyed)
+	}
+	return sb.String()
+}
+
+// checksumWriter feeds values straight into a hash, without formatting them first.
+type checksumWriter struct {
+	h   hash.Hash64
+	buf [8]byte
+}
+
+func (w *checksumWriter) writeUint64(v uint64) {
+	binary.LittleEndian.PutUint64(w.buf[:], v)
+	w.h.Write(w.buf[:])
+}
+
+func (w *checksumWriter) writeInt(v int) {
+	w.writeUint64(uint64(v))
+}
+
+func (w *checksumWriter) writeFloat(v float64) {
+	w.writeUint64(math.Float64bits(v))
+}
+
+func (w *checksumWriter) writeBool(v bool) {
+	if v {
+		w.h.Write([]byte{1})
+	} else {
+		w.h.Write([]byte{0})
+	}
+}
+
+func (w *checksumWriter) writeString(v string) {
+	w.writeInt(len(v))
+	w.h.Write([]byte(v))
+}
+
+// Checksum hashes everything the simulation depends on.
+func (s *World) Checksum() uint64 {
+	w := &checksumWriter{h: fnv.New64a()}
+	w.writeInt(s.tick)
+	w.writeUint64(s.rng.state)
+	w.writeUint64(s.rng.draws)
+	if s.activeMap == nil {
+		return w.h.Sum64()
+	}
+	w.writeString(s.activeMap.filename)
+	for _, a := range s.activeMap.actors {
+		x, y, width, height := a.Bounds()
+		w.writeString(reflect.TypeOf(a).String())
+		w.writeFloat(x)
+		w.writeFloat(y)
+		w.writeFloat(width)
+		w.writeFloat(height)
+		w.writeBool(a.Dead())
+		w.writeBool(a.Destroyed())
+	}
+	for _, in := range s.activeMap.interactives {
+		w.writeString(in.id)
+		w.writeBool(in.active)
+		w.writeInt(in.activationIdx)
+		w.writeInt(in.hp)
+	}
+	for _, b := range s.activeMap.bullets {
+		w.writeFloat(b.Shape.X)
+		w.writeFloat(b.Shape.Y)
+		w.writeFloat(b.Angle)
+		w.writeFloat(b.Speed)
+		w.writeInt(b.Lifetime)
+		w.writeBool(b.reversed)
+		w.writeBool(b.deflected)
+		w.writeBool(b.Destroyed)
+	}
+	return w.h.Sum64()
+}
+
+// checksumsKeptFor returns how many ticks back our own checksums are kept.
+func (s *World) checksumsKeptFor() int {
+	kept := checksumsKept * ChecksumInterval
+	if window := s.rollbackTicks() + ChecksumInterval; kept < window {
+		kept = window
+	}
+	return kept
+}
+
+// recordChecksum stores our checksum for the tick just processed.
+func (s *World) recordChecksum(tick int) WorldChecksum {
+	sum := s.Checksum()
+	if s.checksums == nil {
+		s.checksums = make(map[int]localChecksum)
+	}
+	s.checksums[tick] = localChecksum{sum: sum}
+	for t := range s.checksums {
+		if t <= tick-s.checksumsKeptFor() {
+			delete(s.checksums, t)
+		}
+	}
+	return WorldChecksum{Tick: uint32(tick), Sum: sum}
+}
+
+// HandleWorldChecksum holds on to a peer's checksum until we have processed the same tick.
+func (s *World) HandleWorldChecksum(peer *net.Peer, msg WorldChecksum) {
+	s.remoteChecksums = append(s.remoteChecksums, remoteChecksum{
+		peer: peer,
+		tick: int(msg.Tick),
+		sum:  msg.Sum,
+	})
+	s.compareChecksums()
+}
+
+// compareChecksums compares the peers' checksums against ours for each tick we have both for.
+func (s *World) compareChecksums() {
+	remaining := s.remoteChecksums[:0]
+	for _, remote := range s.remoteChecksums {
+		local, ok := s.checksums[remote.tick]
+		if !ok {
+			// Keep it if we have yet to settle the tick, as our checksum is only taken once we have.
+			if remote.tick > s.tick || remote.tick > s.confirmedTick() {
+				remaining = append(remaining, remote)
+			} else {
+				s.missedChecksums++
+				fmt.Printf("missed checksum from %d for tick %d, %d missed so far\n", remote.peer.ID(), remote.tick, s.missedChecksums)
+			}
+			continue
+		}
+		if local.sum != remote.sum {
+			s.HandleDesync(EventDesync{
+				Peer:   remote.peer,
+				Tick:   remote.tick,
+				Local:  local.sum,
+				Remote: remote.sum,
+			})
+		}
+	}
+	s.remoteChecksums = remaining
+}
+
+// HandleDesync dumps our state for the first desync with a peer and sends it to them.
+func (s *World) HandleDesync(e EventDesync) {
+	if s.desynced == nil {
+		s.desynced = make(map[*net.Peer]int)
+	}
+	if _, ok := s.desynced[e.Peer]; ok {
+		return
+	}
+	s.desynced[e.Peer] = e.Tick
+
+	fmt.Printf("desync with %d at tick %d: %016x != %016x\n", e.Peer.ID(), e.Tick, e.Local, e.Remote)
+	dump := s.DumpState()
+	s.writeDesyncDump(s.Net.ID(), e.Tick, dump)
+	e.Peer.Send(DesyncState{
+		Tick: uint32(s.tick),
+		Dump: dump,
+	})
+}
+
+// HandleDesyncState writes a peer's state dump next to ours.
+func (s *World) HandleDesyncState(peer *net.Peer, msg DesyncState) {
+	tick, ok := s.desynced[peer]
+	if !ok || s.desyncDumps[peer] {
+		return
+	}
+	if s.desyncDumps == nil {
+		s.desyncDumps = make(map[*net.Peer]bool)
+	}
+	s.desyncDumps[peer] = true
+	s.writeDesyncDump(peer.ID(), tick, msg.Dump)
+}
+
+func (s *World) writeDesyncDump(id uint32, tick int, dump string) {
+	name := fmt.Sprintf("desync-%d-%d.txt", tick, id)
+	if err := os.WriteFile(name, []byte(dump), 0644); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("wrote", name)
+}
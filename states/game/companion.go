@@ -83,8 +83,8 @@ func (p *Companion) Update() (actions []Action) {
 			Img:   "life",
 			X:     p.shape.X,
 			Y:     p.shape.Y,
-			Angle: math.Pi + rng.Float64()*math.Pi,
-			Speed: rng.Float64() * 0.5,
+			Angle: math.Pi + fxRNG.Float64()*math.Pi,
+			Speed: fxRNG.Float64() * 0.5,
 			Life:  40,
 		})
 	}
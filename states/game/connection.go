@@ -0,0 +1,89 @@
+package game
+
+import (
+	"image/color"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/ketMix/retromancer/resources"
+	"github.com/ketMix/retromancer/states"
+	"github.com/tinne26/etxt"
+)
+
+// timedOutPlayer returns the first remote player we have lost contact with, if any.
+func (s *World) timedOutPlayer() *RemotePlayer {
+	for _, player := range s.Players {
+		if player, ok := player.(*RemotePlayer); ok && player.timedOut {
+			return player
+		}
+	}
+	return nil
+}
+
+// updateConnectionPrompt handles the reconnect prompt. It returns true if the world should stay paused.
+func (s *World) updateConnectionPrompt(ctx states.Context) bool {
+	player := s.timedOutPlayer()
+	if player == nil {
+		return false
+	}
+	if player.reconnecting {
+		return true
+	}
+
+	reconnect := inpututil.IsKeyJustPressed(ebiten.KeyEnter)
+	quit := inpututil.IsKeyJustPressed(ebiten.KeyEscape)
+	for _, p := range s.Players {
+		if local, ok := p.(*LocalPlayer); ok && local.GamepadID >= 0 {
+			reconnect = reconnect || resources.GetButton(local.GamepadMap, local.GamepadID, resources.ButtonStart)
+			quit = quit || resources.GetButton(local.GamepadMap, local.GamepadID, resources.ButtonBack)
+		}
+	}
+
+	// A player lost while the host changed has nothing to reconnect to.
+	if reconnect && player.peer != nil {
+		player.reconnecting = true
+		s.Net.Reconnect(player.peer)
+	} else if quit {
+		s.Net.Close()
+		ctx.StateMachine.PopState(nil)
+	}
+	return true
+}
+
+func (s *World) drawConnectionPrompt(ctx states.DrawContext) {
+	player := s.timedOutPlayer()
+	if player == nil {
+		return
+	}
+
+	lines := []string{ctx.L.Get("Reconnect"), ctx.L.Get("Quit")}
+	if player.peer == nil {
+		lines = lines[1:]
+	}
+	if player.reconnecting {
+		lines = []string{ctx.L.Get("Reconnecting")}
+	}
+
+	ctx.Text.SetAlign(etxt.YCenter | etxt.XCenter)
+	x := ctx.Screen.Bounds().Max.X / 2
+	y := float64(ctx.Screen.Bounds().Max.Y / 2)
+	y -= ctx.Text.Utils().GetLineHeight() / 2
+	// Title
+	{
+		ctx.Text.SetScale(2.0)
+		ctx.Text.SetColor(color.RGBA{0x00, 0x00, 0x00, 0xff})
+		resources.DrawTextOutline(ctx.Text, ctx.Screen, ctx.L.Get("ConnectionLost"), x, int(y), 2)
+		ctx.Text.SetColor(color.RGBA{0xff, 0xff, 0x00, 0xff})
+		ctx.Text.Draw(ctx.Screen, ctx.L.Get("ConnectionLost"), x, int(y))
+	}
+	y += ctx.Text.Utils().GetLineHeight()
+	// Options
+	ctx.Text.SetScale(1.0)
+	for _, line := range lines {
+		ctx.Text.SetColor(color.Black)
+		resources.DrawTextOutline(ctx.Text, ctx.Screen, line, x, int(y), 1)
+		ctx.Text.SetColor(color.White)
+		ctx.Text.Draw(ctx.Screen, line, x, int(y))
+		y += ctx.Text.Utils().GetLineHeight()
+	}
+}
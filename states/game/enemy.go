@@ -2,6 +2,7 @@ package game
 
 import (
 	"math"
+	"math/rand"
 
 	"github.com/ketMix/retromancer/states"
 
@@ -21,6 +22,8 @@ const (
 type Enemy struct {
 	ctx               *states.Context
 	id                string
+	name              string // Name of the enemy's definition.
+	rng               *rand.Rand
 	sprite            *resources.Sprite
 	deadSprite        *resources.Sprite
 	hitSfx            *resources.Sound
@@ -44,7 +47,7 @@ type Enemy struct {
 	ticksUntilSfx     int // Ticks since last hit sound effect.
 }
 
-func CreateEnemy(ctx states.Context, id, enemyName string) *Enemy {
+func CreateEnemy(ctx states.Context, rng *rand.Rand, id, enemyName string) *Enemy {
 	// Get the enemy definition using enemy name and difficulty
 	// If difficulty definition doesn't exist, use base definition
 	enemyDef := ctx.R.GetAs("enemies", enemyName+"-"+string(ctx.Difficulty), (*resources.Enemy)(nil)).(*resources.Enemy)
@@ -78,7 +81,7 @@ func CreateEnemy(ctx states.Context, id, enemyName string) *Enemy {
 	// Create the spawner
 	var spawner *Spawner
 	if enemyDef.Bullets != nil {
-		spawner = CreateSpawner(ctx, enemyDef.Bullets)
+		spawner = CreateSpawner(ctx, rng, enemyDef.Bullets)
 	}
 
 	firstState := EnemyStateHunt
@@ -90,6 +93,8 @@ func CreateEnemy(ctx states.Context, id, enemyName string) *Enemy {
 
 	return &Enemy{
 		id:         id,
+		name:       enemyName,
+		rng:        rng,
 		ctx:        &ctx,
 		state:      firstState,
 		sprite:     aliveSprite,
@@ -204,8 +209,8 @@ func (e *Enemy) Update() (a []Action) {
 		case EnemyStateWander:
 			e.rethinkTime++
 			if e.rethinkTime > 0 {
-				e.rethinkTime = -(30 + rng.Intn(20))
-				e.wanderDir = math.Pi * 2 * rng.Float64()
+				e.rethinkTime = -(30 + e.rng.Intn(20))
+				e.wanderDir = math.Pi * 2 * e.rng.Float64()
 				if e.target == nil {
 					a = append(a, ActionFindNearestActor{Actor: (*PC)(nil)})
 				}
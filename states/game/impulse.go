@@ -25,7 +25,7 @@ type Impulse interface {
 	Cost() int
 	Ident() uint8
 	ToBytes() []byte
-	FromBytes([]byte) (net.Message, int)
+	FromBytes([]byte) (net.Message, int, error)
 }
 
 type ImpulseMove struct {
@@ -65,19 +65,63 @@ func (i ImpulseShoot) Cost() int {
 
 // Networking crap
 
+// Impulses are quantized, for everyone, to keep TickStates small.
+const (
+	angleSteps    = 1 << 16 // Steps in a full turn that move directions are sent in.
+	positionSteps = 16      // Steps per pixel that cursor coordinates are sent in.
+)
+
+// quantizeAngle turns an angle into a fixed-point fraction of a turn.
+func quantizeAngle(a float64) uint16 {
+	return uint16(int64(math.Round(a / (2 * math.Pi) * angleSteps)))
+}
+
+// dequantizeAngle turns a quantized angle back into radians in the range [-pi, pi).
+func dequantizeAngle(q uint16) float64 {
+	return float64(int16(q)) * 2 * math.Pi / angleSteps
+}
+
+// appendPosition appends cursor coordinates as fixed-point varints.
+func appendPosition(b []byte, x, y float64) []byte {
+	b = binary.AppendVarint(b, int64(math.Round(x*positionSteps)))
+	b = binary.AppendVarint(b, int64(math.Round(y*positionSteps)))
+	return b
+}
+
+// readPosition reads cursor coordinates written by appendPosition.
+func readPosition(b []byte) (x, y float64, n int) {
+	qx, nx := binary.Varint(b)
+	if nx <= 0 {
+		return 0, 0, -1
+	}
+	qy, ny := binary.Varint(b[nx:])
+	if ny <= 0 {
+		return 0, 0, -1
+	}
+	return float64(qx) / positionSteps, float64(qy) / positionSteps, nx + ny
+}
+
+// quantizePosition rounds cursor coordinates the same way sending them does.
+func quantizePosition(x, y float64) (float64, float64) {
+	return math.Round(x*positionSteps) / positionSteps, math.Round(y*positionSteps) / positionSteps
+}
+
 func (i ImpulseMove) Ident() uint8 {
 	return 30
 }
 
 func (i ImpulseMove) ToBytes() (b []byte) {
 	b = append(b, i.Ident())
-	b = binary.LittleEndian.AppendUint64(b, uint64(math.Float64bits(i.Direction)))
+	b = binary.LittleEndian.AppendUint16(b, quantizeAngle(i.Direction))
 	return
 }
 
-func (i ImpulseMove) FromBytes(b []byte) (net.Message, int) {
-	i.Direction = math.Float64frombits(binary.LittleEndian.Uint64(b[1:]))
-	return i, 9
+func (i ImpulseMove) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 3 {
+		return nil, 0, net.ErrShortMessage
+	}
+	i.Direction = dequantizeAngle(binary.LittleEndian.Uint16(b[1:]))
+	return i, 3, nil
 }
 
 func (i ImpulseReverse) Ident() uint8 {
@@ -86,15 +130,17 @@ func (i ImpulseReverse) Ident() uint8 {
 
 func (i ImpulseReverse) ToBytes() (b []byte) {
 	b = append(b, i.Ident())
-	b = binary.LittleEndian.AppendUint64(b, uint64(math.Float64bits(i.X)))
-	b = binary.LittleEndian.AppendUint64(b, uint64(math.Float64bits(i.Y)))
+	b = appendPosition(b, i.X, i.Y)
 	return
 }
 
-func (i ImpulseReverse) FromBytes(b []byte) (net.Message, int) {
-	i.X = math.Float64frombits(binary.LittleEndian.Uint64(b[1:]))
-	i.Y = math.Float64frombits(binary.LittleEndian.Uint64(b[9:]))
-	return i, 17
+func (i ImpulseReverse) FromBytes(b []byte) (net.Message, int, error) {
+	x, y, n := readPosition(b[1:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	i.X, i.Y = x, y
+	return i, 1 + n, nil
 }
 
 func (i ImpulseDeflect) Ident() uint8 {
@@ -103,15 +149,17 @@ func (i ImpulseDeflect) Ident() uint8 {
 
 func (i ImpulseDeflect) ToBytes() (b []byte) {
 	b = append(b, i.Ident())
-	b = binary.LittleEndian.AppendUint64(b, uint64(math.Float64bits(i.X)))
-	b = binary.LittleEndian.AppendUint64(b, uint64(math.Float64bits(i.Y)))
+	b = appendPosition(b, i.X, i.Y)
 	return
 }
 
-func (i ImpulseDeflect) FromBytes(b []byte) (net.Message, int) {
-	i.X = math.Float64frombits(binary.LittleEndian.Uint64(b[1:]))
-	i.Y = math.Float64frombits(binary.LittleEndian.Uint64(b[9:]))
-	return i, 17
+func (i ImpulseDeflect) FromBytes(b []byte) (net.Message, int, error) {
+	x, y, n := readPosition(b[1:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	i.X, i.Y = x, y
+	return i, 1 + n, nil
 }
 
 func (i ImpulseShield) Ident() uint8 {
@@ -123,8 +171,8 @@ func (i ImpulseShield) ToBytes() (b []byte) {
 	return
 }
 
-func (i ImpulseShield) FromBytes(b []byte) (net.Message, int) {
-	return i, 1
+func (i ImpulseShield) FromBytes(b []byte) (net.Message, int, error) {
+	return i, 1, nil
 }
 
 func (i ImpulseShoot) Ident() uint8 {
@@ -133,72 +181,115 @@ func (i ImpulseShoot) Ident() uint8 {
 
 func (i ImpulseShoot) ToBytes() (b []byte) {
 	b = append(b, i.Ident())
-	b = binary.LittleEndian.AppendUint64(b, uint64(math.Float64bits(i.X)))
-	b = binary.LittleEndian.AppendUint64(b, uint64(math.Float64bits(i.Y)))
+	b = appendPosition(b, i.X, i.Y)
 	return
 }
 
-func (i ImpulseShoot) FromBytes(b []byte) (net.Message, int) {
-	i.X = math.Float64frombits(binary.LittleEndian.Uint64(b[1:]))
-	i.Y = math.Float64frombits(binary.LittleEndian.Uint64(b[9:]))
-	return i, 17
+func (i ImpulseShoot) FromBytes(b []byte) (net.Message, int, error) {
+	x, y, n := readPosition(b[1:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	i.X, i.Y = x, y
+	return i, 1 + n, nil
 }
 
+// Quantized returns the impulses as they would arrive at a peer.
+func (i ImpulseSet) Quantized() ImpulseSet {
+	if i.Move != nil {
+		move := ImpulseMove{Direction: dequantizeAngle(quantizeAngle(i.Move.Direction))}
+		i.Move = &move
+	}
+	switch interaction := i.Interaction.(type) {
+	case ImpulseReverse:
+		interaction.X, interaction.Y = quantizePosition(interaction.X, interaction.Y)
+		i.Interaction = interaction
+	case ImpulseDeflect:
+		interaction.X, interaction.Y = quantizePosition(interaction.X, interaction.Y)
+		i.Interaction = interaction
+	case ImpulseShoot:
+		interaction.X, interaction.Y = quantizePosition(interaction.X, interaction.Y)
+		i.Interaction = interaction
+	}
+	return i
+}
+
+// Equal returns whether both sets hold the same impulses.
+func (i ImpulseSet) Equal(o ImpulseSet) bool {
+	if (i.Move == nil) != (o.Move == nil) || (i.Move != nil && *i.Move != *o.Move) {
+		return false
+	}
+	return i.Interaction == o.Interaction
+}
+
+// ImpulseSet flags.
+const (
+	impulseSetMove uint8 = 1 << iota
+	impulseSetInteraction
+)
+
 func (i ImpulseSet) Ident() uint8 {
 	return 35
 }
 
 func (i ImpulseSet) ToBytes() (b []byte) {
 	b = append(b, i.Ident())
+	var flags uint8
 	if i.Move != nil {
-		b = append(b, byte(1))
-		b = append(b, i.Move.ToBytes()...)
-	} else {
-		b = append(b, byte(0))
+		flags |= impulseSetMove
+	}
+	if i.Interaction != nil {
+		flags |= impulseSetInteraction
+	}
+	b = append(b, flags)
+	// The flag already says it is a move, so only its direction is sent.
+	if i.Move != nil {
+		b = binary.LittleEndian.AppendUint16(b, quantizeAngle(i.Move.Direction))
 	}
 	if i.Interaction != nil {
-		b = append(b, byte(1))
 		b = append(b, i.Interaction.ToBytes()...)
 	}
 	return
 }
 
-func (i ImpulseSet) FromBytes(b []byte) (net.Message, int) {
+func (i ImpulseSet) FromBytes(b []byte) (net.Message, int, error) {
 	i.Move = nil
 	i.Interaction = nil
-	offset := 1
-	if b[offset] == 1 {
-		offset++
-		m, n := (ImpulseMove{}).FromBytes(b[offset:])
-		argh := m.(ImpulseMove)
-		i.Move = &argh
-		offset += n
-	} else {
-		offset++
+	if len(b) < 2 {
+		return nil, 0, net.ErrShortMessage
 	}
-	if len(b) == offset {
-		return i, offset
+	flags := b[1]
+	offset := 2
+	if flags&impulseSetMove != 0 {
+		if len(b) < offset+2 {
+			return nil, 0, net.ErrShortMessage
+		}
+		i.Move = &ImpulseMove{Direction: dequantizeAngle(binary.LittleEndian.Uint16(b[offset:]))}
+		offset += 2
 	}
-	if b[offset] == 1 {
-		offset++
+	if flags&impulseSetInteraction != 0 {
+		if len(b) == offset {
+			return nil, 0, net.ErrShortMessage
+		}
+		var interaction Impulse
 		switch b[offset] {
 		case (ImpulseReverse{}).Ident():
-			m, n := (ImpulseReverse{}).FromBytes(b[offset:])
-			i.Interaction = m.(Impulse)
-			offset += n
+			interaction = ImpulseReverse{}
 		case (ImpulseDeflect{}).Ident():
-			m, n := (ImpulseDeflect{}).FromBytes(b[offset:])
-			i.Interaction = m.(Impulse)
-			offset += n
+			interaction = ImpulseDeflect{}
 		case (ImpulseShield{}).Ident():
-			m, n := (ImpulseShield{}).FromBytes(b[offset:])
-			i.Interaction = m.(Impulse)
-			offset += n
+			interaction = ImpulseShield{}
 		case (ImpulseShoot{}).Ident():
-			m, n := (ImpulseShoot{}).FromBytes(b[offset:])
-			i.Interaction = m.(Impulse)
-			offset += n
+			interaction = ImpulseShoot{}
+		default:
+			return nil, 0, net.ErrUnexpectedMessage
 		}
+		m, n, err := interaction.FromBytes(b[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		i.Interaction = m.(Impulse)
+		offset += n
 	}
-	return i, offset
+	return i, offset, nil
 }
@@ -0,0 +1,484 @@
+package game
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ketMix/retromancer/net"
+	"github.com/ketMix/retromancer/resources"
+	"github.com/ketMix/retromancer/states"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+func init() {
+	net.RegisterMessage(GameUnderway{})
+	net.RegisterMessage(JoinRequest{})
+	net.RegisterMessage(JoinSnapshot{})
+	net.RegisterMessage(PlayerJoined{})
+}
+
+// GameUnderway is sent by the host to anyone who connects once the game has begun.
+type GameUnderway struct{}
+
+func (m GameUnderway) Ident() uint8 {
+	return 29
+}
+
+func (m GameUnderway) ToBytes() []byte {
+	return []byte{m.Ident()}
+}
+
+func (m GameUnderway) FromBytes(b []byte) (net.Message, int, error) {
+	return m, 1, nil
+}
+
+// JoinRequest asks the host to drop the sender's players into the game underway.
+type JoinRequest struct {
+	Hats []string // Hat of each of the sender's players.
+}
+
+func (m JoinRequest) Ident() uint8 {
+	return 36
+}
+
+func (m JoinRequest) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = append(b, uint8(len(m.Hats)))
+	for _, hat := range m.Hats {
+		b = net.AppendString(b, hat)
+	}
+	return
+}
+
+func (m JoinRequest) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 2 {
+		return nil, 0, net.ErrShortMessage
+	}
+	count := int(b[1])
+	offset := 2
+	m.Hats = nil
+	for i := 0; i < count; i++ {
+		hat, n := net.ReadString(b[offset:])
+		if n < 0 {
+			return nil, 0, net.ErrShortMessage
+		}
+		m.Hats = append(m.Hats, hat)
+		offset += n
+	}
+	return m, offset, nil
+}
+
+// JoinSlot is a player already in the game, as a newcomer needs to know them.
+type JoinSlot struct {
+	Owner     uint32
+	Hat       string
+	Companion bool // Set if the player has a Companion rather than a PC.
+	Left      bool // Set if the player has left for good. Newcomers are only let in once such players have run out of impulses.
+}
+
+// maxWorldSize is the most a JoinSnapshot's world may unpack to.
+const maxWorldSize = 8 << 20
+
+// JoinSnapshot is everything a newcomer needs to drop into a game underway.
+type JoinSnapshot struct {
+	Tick       uint32
+	JoinTick   uint32
+	InputDelay uint8
+	Difficulty string
+	Map        string
+	Slots      []JoinSlot
+	World      []byte // The rest of the world, as written by encodeWorld. It is compressed on the way.
+}
+
+func (m JoinSnapshot) Ident() uint8 {
+	return 37
+}
+
+func (m JoinSnapshot) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = binary.LittleEndian.AppendUint32(b, m.Tick)
+	b = binary.LittleEndian.AppendUint32(b, m.JoinTick)
+	b = append(b, m.InputDelay)
+	b = net.AppendString(b, m.Difficulty)
+	b = net.AppendString(b, m.Map)
+	b = append(b, uint8(len(m.Slots)))
+	for _, slot := range m.Slots {
+		b = binary.LittleEndian.AppendUint32(b, slot.Owner)
+		b = net.AppendString(b, slot.Hat)
+		var flags uint8
+		if slot.Companion {
+			flags |= 1
+		}
+		if slot.Left {
+			flags |= 2
+		}
+		b = append(b, flags)
+	}
+
+	var world bytes.Buffer
+	w, _ := flate.NewWriter(&world, flate.BestSpeed)
+	w.Write(m.World)
+	w.Close()
+	b = binary.LittleEndian.AppendUint32(b, uint32(world.Len()))
+	b = append(b, world.Bytes()...)
+	return
+}
+
+func (m JoinSnapshot) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 10 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Tick = binary.LittleEndian.Uint32(b[1:])
+	m.JoinTick = binary.LittleEndian.Uint32(b[5:])
+	m.InputDelay = b[9]
+	offset := 10
+
+	var n int
+	if m.Difficulty, n = net.ReadString(b[offset:]); n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+	if m.Map, n = net.ReadString(b[offset:]); n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+
+	if len(b) < offset+1 {
+		return nil, 0, net.ErrShortMessage
+	}
+	count := int(b[offset])
+	offset++
+	m.Slots = nil
+	for i := 0; i < count; i++ {
+		var slot JoinSlot
+		if len(b) < offset+4 {
+			return nil, 0, net.ErrShortMessage
+		}
+		slot.Owner = binary.LittleEndian.Uint32(b[offset:])
+		offset += 4
+		if slot.Hat, n = net.ReadString(b[offset:]); n < 0 {
+			return nil, 0, net.ErrShortMessage
+		}
+		offset += n
+		if len(b) < offset+1 {
+			return nil, 0, net.ErrShortMessage
+		}
+		slot.Companion = b[offset]&1 != 0
+		slot.Left = b[offset]&2 != 0
+		offset++
+		m.Slots = append(m.Slots, slot)
+	}
+
+	if len(b) < offset+4 {
+		return nil, 0, net.ErrShortMessage
+	}
+	size := int(binary.LittleEndian.Uint32(b[offset:]))
+	offset += 4
+	if size < 0 || len(b) < offset+size {
+		return nil, 0, net.ErrShortMessage
+	}
+	// Don't unpack more than a world could take up.
+	world, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(b[offset:offset+size])), maxWorldSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(world) > maxWorldSize {
+		return nil, 0, ErrBadJoinState
+	}
+	m.World = world
+	return m, offset + size, nil
+}
+
+// PlayerJoined tells everyone about a newcomer's players, which join on Tick.
+type PlayerJoined struct {
+	Tick  uint32
+	Owner uint32
+	Hats  []string
+}
+
+func (m PlayerJoined) Ident() uint8 {
+	return 38
+}
+
+func (m PlayerJoined) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = binary.LittleEndian.AppendUint32(b, m.Tick)
+	b = binary.LittleEndian.AppendUint32(b, m.Owner)
+	b = append(b, uint8(len(m.Hats)))
+	for _, hat := range m.Hats {
+		b = net.AppendString(b, hat)
+	}
+	return
+}
+
+func (m PlayerJoined) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 10 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Tick = binary.LittleEndian.Uint32(b[1:])
+	m.Owner = binary.LittleEndian.Uint32(b[5:])
+	count := int(b[9])
+	offset := 10
+	m.Hats = nil
+	for i := 0; i < count; i++ {
+		hat, n := net.ReadString(b[offset:])
+		if n < 0 {
+			return nil, 0, net.ErrShortMessage
+		}
+		m.Hats = append(m.Hats, hat)
+		offset += n
+	}
+	return m, offset, nil
+}
+
+// Join is what a world started in the middle of a game underway picks up from.
+type Join struct {
+	Host     *net.Peer
+	Snapshot JoinSnapshot
+}
+
+// joinRequest is a newcomer waiting for the host to drop them in.
+type joinRequest struct {
+	peer *net.Peer
+	hats []string
+}
+
+// pendingJoin is players to be added to the game on the given tick.
+type pendingJoin struct {
+	tick    int
+	players []Player
+}
+
+// HandleJoinConnect lets newcomers know to ask to drop in.
+func (s *World) HandleJoinConnect(peer *net.Peer) {
+	if !s.Net.Hosting {
+		return
+	}
+	for _, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && remote.owner == peer.ID() {
+			return
+		}
+	}
+	peer.Send(GameUnderway{})
+}
+
+// HandleJoinRequest queues up a newcomer, or turns them away if there is no room.
+func (s *World) HandleJoinRequest(peer *net.Peer, msg JoinRequest) {
+	if !s.Net.Hosting {
+		return
+	}
+	count := len(s.Players) + len(s.joiningPlayers()) + len(msg.Hats)
+	for _, req := range s.joinRequests {
+		if req.peer == peer {
+			return
+		}
+		count += len(req.hats)
+	}
+	if count > MaxPlayers {
+		s.Net.Reject(peer, "Game is full")
+		return
+	}
+	s.joinRequests = append(s.joinRequests, joinRequest{peer: peer, hats: msg.Hats})
+}
+
+// updateJoins drops the next waiting newcomer into the game, once everyone agrees on the world.
+func (s *World) updateJoins() {
+	if len(s.joinRequests) == 0 || s.snapshot != nil {
+		return
+	}
+	if _, ok := s.CurrentState().(*WorldStateLive); !ok {
+		return
+	}
+	if len(s.joiningPlayers()) > 0 {
+		return
+	}
+	for _, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && remote.departed && (!remote.left || remote.lastTick > s.tick) {
+			return
+		}
+	}
+
+	req := s.joinRequests[0]
+	s.joinRequests = s.joinRequests[1:]
+	if req.peer.Rejected() || req.peer.TimedOut() {
+		return
+	}
+
+	// Join on the first tick our impulses have yet to be sent for.
+	joinTick := s.tick + s.inputDelay() + 1
+	snapshot := JoinSnapshot{
+		Tick:       uint32(s.tick),
+		JoinTick:   uint32(joinTick),
+		InputDelay: uint8(s.inputDelay()),
+		Map:        s.activeMap.filename,
+		World:      s.encodeWorld(),
+	}
+	if s.Difficulty != nil {
+		snapshot.Difficulty = string(*s.Difficulty)
+	}
+	for _, player := range s.Players {
+		slot := JoinSlot{Hat: player.Hat()}
+		_, slot.Companion = player.Actor().(*Companion)
+		switch player := player.(type) {
+		case *LocalPlayer:
+			slot.Owner = s.Net.ID()
+		case *RemotePlayer:
+			slot.Owner = player.owner
+			slot.Left = player.left
+		}
+		snapshot.Slots = append(snapshot.Slots, slot)
+	}
+
+	if len(req.hats) > 0 {
+		players := make([]Player, len(req.hats))
+		for i, hat := range req.hats {
+			remote := NewRemotePlayer(req.peer)
+			remote.SetOwner(req.peer.ID())
+			remote.SetHat(hat)
+			remote.lastTick = joinTick - 1 + s.inputDelay()
+			players[i] = remote
+		}
+		announce := PlayerJoined{Tick: uint32(joinTick), Owner: req.peer.ID(), Hats: req.hats}
+		for _, peer := range s.TickPeers() {
+			peer.Send(announce)
+		}
+		s.joins = append(s.joins, pendingJoin{tick: joinTick, players: players})
+	}
+
+	req.peer.Queue(snapshot)
+	s.ReplayTicks(req.peer, s.tick)
+}
+
+// HandlePlayerJoined gets ready for a newcomer's players.
+func (s *World) HandlePlayerJoined(peer *net.Peer, msg PlayerJoined) {
+	if s.Net.Hosting || len(msg.Hats) == 0 {
+		return
+	}
+	tick := int(msg.Tick)
+	players := make([]Player, len(msg.Hats))
+	for i, hat := range msg.Hats {
+		remote := NewRemotePlayer(peer)
+		remote.SetOwner(msg.Owner)
+		remote.SetHat(hat)
+		remote.lastTick = tick - 1 + s.inputDelay()
+		players[i] = remote
+	}
+	s.joins = append(s.joins, pendingJoin{tick: tick, players: players})
+}
+
+// addJoiningPlayers adds the players that join on the given tick.
+func (s *World) addJoiningPlayers(ctx states.Context, tick int) {
+	joins := s.joins[:0]
+	for _, join := range s.joins {
+		if join.tick == tick {
+			for _, player := range join.players {
+				s.addJoiningPlayer(ctx, player)
+			}
+		}
+		if join.tick >= tick-inputsKept {
+			joins = append(joins, join)
+		}
+	}
+	s.joins = joins
+}
+
+// addJoiningPlayer gives a newcomer a Companion next to the first player.
+func (s *World) addJoiningPlayer(ctx states.Context, player Player) {
+	s.newPlayerActor(ctx, player, false)
+	x, y, _, _ := s.Players[0].Actor().Bounds()
+	player.Actor().SetXY(x, y)
+	player.Actor().Save()
+	if local, ok := player.(*LocalPlayer); ok {
+		local.sentImpulses = ImpulseSet{}
+	}
+	s.Players = append(s.Players, player)
+	s.activeMap.actors = append(s.activeMap.actors, player.Actor())
+}
+
+// newPlayerActor gives a player a PC or a Companion wearing their hat.
+func (s *World) newPlayerActor(ctx states.Context, p Player, isPC bool) {
+	hat := resources.NewSprite(ctx.R.GetAs("images", p.Hat(), (*ebiten.Image)(nil)).(*ebiten.Image))
+	if isPC {
+		pc := s.NewPC(ctx)
+		pc.Hat = hat
+
+		// If the starting map is not start, then set the player as resurrected.
+		if s.StartingMap != "start" {
+			pc.resurrected = true
+		}
+
+		p.SetActor(pc)
+	} else {
+		c := s.NewCompanion(ctx)
+		c.Hat = hat
+		p.SetActor(c)
+	}
+}
+
+// joiningPlayers returns the players that are yet to be added, in slot order.
+func (s *World) joiningPlayers() (players []Player) {
+	for _, join := range s.joins {
+		added := false
+		for _, p := range s.Players {
+			if p == join.players[0] {
+				added = true
+				break
+			}
+		}
+		if !added {
+			players = append(players, join.players...)
+		}
+	}
+	return
+}
+
+// playerInSlot returns the player in the given slot, counting those yet to join.
+func (s *World) playerInSlot(slot int) Player {
+	if slot < len(s.Players) {
+		return s.Players[slot]
+	}
+	joining := s.joiningPlayers()
+	if slot-len(s.Players) < len(joining) {
+		return joining[slot-len(s.Players)]
+	}
+	return nil
+}
+
+// startJoin takes the players already in the game from the host's snapshot.
+func (s *World) startJoin() {
+	snap := s.Join.Snapshot
+	locals := s.Players
+	s.Players = nil
+	for _, slot := range snap.Slots {
+		remote := NewRemotePlayer(s.Join.Host)
+		remote.SetOwner(slot.Owner)
+		remote.SetHat(slot.Hat)
+		remote.departed = slot.Left
+		remote.left = slot.Left
+		s.Players = append(s.Players, remote)
+	}
+	if len(locals) > 0 {
+		s.joins = append(s.joins, pendingJoin{tick: int(snap.JoinTick), players: locals})
+	}
+	s.StartingMap = snap.Map
+	s.InputDelay = int(snap.InputDelay)
+	difficulty := states.Difficulty(snap.Difficulty)
+	s.Difficulty = &difficulty
+}
+
+// finishJoin picks the freshly loaded world up from where the host's snapshot left it.
+func (s *World) finishJoin(ctx states.Context) error {
+	snap := s.Join.Snapshot
+	s.tick = int(snap.Tick)
+	for _, player := range s.Players {
+		player.(*RemotePlayer).lastTick = s.tick
+	}
+	if err := s.decodeWorld(ctx, snap.World); err != nil {
+		return fmt.Errorf("joining game: %w", err)
+	}
+	return nil
+}
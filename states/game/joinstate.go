@@ -0,0 +1,657 @@
+package game
+
+import (
+	"encoding/binary"
+	"errors"
+	"image/color"
+	"math"
+
+	"github.com/ketMix/retromancer/states"
+)
+
+// ErrBadJoinState is returned when the world sent by the host cannot be made sense of.
+var ErrBadJoinState = errors.New("bad world state from host")
+
+// stateWriter writes the parts of the world a newcomer cannot load for themselves.
+type stateWriter struct {
+	b []byte
+}
+
+func (w *stateWriter) writeInt(v int) {
+	w.b = binary.AppendVarint(w.b, int64(v))
+}
+
+func (w *stateWriter) writeUint64(v uint64) {
+	w.b = binary.LittleEndian.AppendUint64(w.b, v)
+}
+
+func (w *stateWriter) writeFloat(v float64) {
+	w.writeUint64(math.Float64bits(v))
+}
+
+func (w *stateWriter) writeBool(v bool) {
+	if v {
+		w.b = append(w.b, 1)
+	} else {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *stateWriter) writeString(v string) {
+	w.writeInt(len(v))
+	w.b = append(w.b, v...)
+}
+
+func (w *stateWriter) writeColor(c color.Color) {
+	r, g, b, a := c.RGBA()
+	w.b = append(w.b, uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8))
+}
+
+// stateReader reads back what a stateWriter wrote. Check err once at the end.
+type stateReader struct {
+	b   []byte
+	err error
+}
+
+func (r *stateReader) readInt() int {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = ErrBadJoinState
+		return 0
+	}
+	r.b = r.b[n:]
+	return int(v)
+}
+
+// readCount reads the length of something that takes at least a byte per item.
+func (r *stateReader) readCount() int {
+	count := r.readInt()
+	if count < 0 || count > len(r.b) {
+		r.err = ErrBadJoinState
+		return 0
+	}
+	return count
+}
+
+func (r *stateReader) readUint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 8 {
+		r.err = ErrBadJoinState
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *stateReader) readFloat() float64 {
+	return math.Float64frombits(r.readUint64())
+}
+
+func (r *stateReader) readBool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.b) < 1 {
+		r.err = ErrBadJoinState
+		return false
+	}
+	v := r.b[0] != 0
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *stateReader) readString() string {
+	size := r.readCount()
+	if r.err != nil {
+		return ""
+	}
+	v := string(r.b[:size])
+	r.b = r.b[size:]
+	return v
+}
+
+func (r *stateReader) readColor() color.Color {
+	if r.err != nil {
+		return color.RGBA{}
+	}
+	if len(r.b) < 4 {
+		r.err = ErrBadJoinState
+		return color.RGBA{}
+	}
+	c := color.RGBA{r.b[0], r.b[1], r.b[2], r.b[3]}
+	r.b = r.b[4:]
+	return c
+}
+
+// How each actor in the map's actors is found again by a newcomer.
+const (
+	joinActorSpawned = iota // Created by the map, found by its index in the map's actor spawns.
+	joinActorEnemy          // Spawned by another enemy, created anew by its id and name.
+	joinActorPlayer         // A player's actor, found by the player's slot.
+)
+
+// What a player's actor last did, as they only remember the kind.
+const (
+	joinInteractionNone = iota
+	joinInteractionReverse
+	joinInteractionDeflect
+	joinInteractionShield
+	joinInteractionShoot
+)
+
+// encodeWorld writes what a newcomer needs on top of the active map.
+func (s *World) encodeWorld() []byte {
+	w := &stateWriter{}
+	w.writeUint64(s.rng.state)
+	w.writeUint64(s.rng.draws)
+	w.writeInt(len(s.savedNPCs))
+	for npc := range s.savedNPCs {
+		w.writeString(npc)
+	}
+
+	m := s.activeMap
+	w.writeBool(m.cleared)
+	w.writeInt(m.currentZ)
+	// Interactives open up cells as they activate.
+	for _, layer := range m.Cells {
+		for _, row := range layer {
+			for _, cell := range row {
+				w.writeBool(cell.blockMove)
+				w.writeBool(cell.blockView)
+			}
+		}
+	}
+
+	// Players' actors are written on their own, as they may have dropped out of the map's actors.
+	w.writeInt(len(s.Players))
+	for _, p := range s.Players {
+		writePlayerActor(w, p.Actor())
+	}
+
+	// Actors and bullets refer to actors by where they are in the map's actors.
+	refs := make(map[Actor]int)
+	for i, a := range m.actors {
+		refs[a] = i
+	}
+	w.writeInt(len(m.actors))
+	for _, a := range m.actors {
+		s.encodeActor(w, a, refs)
+	}
+	w.writeInt(len(m.enemies))
+	for _, e := range m.enemies {
+		writeRef(w, e, refs)
+	}
+	w.writeInt(len(m.bullets))
+	for _, b := range m.bullets {
+		writeBullet(w, b, refs)
+	}
+	return w.b
+}
+
+// decodeWorld puts the active map, freshly loaded, into the state the host wrote with encodeWorld.
+func (s *World) decodeWorld(ctx states.Context, b []byte) error {
+	r := &stateReader{b: b}
+	s.rng.state = r.readUint64()
+	s.rng.draws = r.readUint64()
+	count := r.readCount()
+	for i := 0; i < count; i++ {
+		s.savedNPCs[r.readString()] = true
+	}
+
+	m := s.activeMap
+	m.cleared = r.readBool()
+	m.currentZ = r.readInt()
+	for z := range m.Cells {
+		for y := range m.Cells[z] {
+			for x := range m.Cells[z][y] {
+				m.Cells[z][y][x].blockMove = r.readBool()
+				m.Cells[z][y][x].blockView = r.readBool()
+			}
+		}
+	}
+
+	if r.readCount() != len(s.Players) {
+		return ErrBadJoinState
+	}
+	for _, p := range s.Players {
+		readPlayerActor(r, p.Actor())
+	}
+
+	// References can only be resolved once every actor is known.
+	var links []func(actors []Actor)
+	count = r.readCount()
+	actors := make([]Actor, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		a := s.decodeActor(ctx, r, &links)
+		if a == nil {
+			r.err = ErrBadJoinState
+			break
+		}
+		actors = append(actors, a)
+	}
+	enemies := make([]*Enemy, r.readCount())
+	for i := range enemies {
+		i := i
+		ref := r.readInt()
+		links = append(links, func(actors []Actor) {
+			enemies[i], _ = actorAt(actors, ref).(*Enemy)
+		})
+	}
+	bullets := make([]*Bullet, r.readCount())
+	for i := range bullets {
+		bullets[i] = readBullet(r, &links)
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	for _, link := range links {
+		link(actors)
+	}
+	for _, e := range enemies {
+		if e == nil {
+			return ErrBadJoinState
+		}
+	}
+	m.actors = actors
+	m.enemies = enemies
+	m.bullets = bullets
+	return nil
+}
+
+// encodeActor writes how to find an actor again, followed by its state.
+func (s *World) encodeActor(w *stateWriter, a Actor, refs map[Actor]int) {
+	for i, p := range s.Players {
+		if p.Actor() == a {
+			w.writeInt(joinActorPlayer)
+			w.writeInt(i)
+			return
+		}
+	}
+	found := false
+	for i, spawned := range s.activeMap.spawned {
+		if spawned == a {
+			w.writeInt(joinActorSpawned)
+			w.writeInt(i)
+			found = true
+			break
+		}
+	}
+	if !found {
+		e := a.(*Enemy)
+		w.writeInt(joinActorEnemy)
+		w.writeString(e.id)
+		w.writeString(e.name)
+	}
+
+	switch a := a.(type) {
+	case *Interactive:
+		w.writeBool(a.active)
+		w.writeInt(a.hp)
+		w.writeInt(a.activationIdx)
+		w.writeInt(a.activateCooldown)
+	case *Spawner:
+		writeSpawner(w, a)
+	case *Snaggable:
+		w.writeFloat(a.shape.X)
+		w.writeFloat(a.shape.Y)
+		w.writeBool(a.destroyed)
+		w.writeInt(a.nextParticle)
+	case *Enemy:
+		w.writeFloat(a.shape.X)
+		w.writeFloat(a.shape.Y)
+		w.writeInt(int(a.state))
+		w.writeFloat(a.wanderDir)
+		w.writeInt(a.rethinkTime)
+		w.writeInt(a.health)
+		w.writeBool(a.friendly)
+		w.writeBool(a.hasDied)
+		w.writeInt(a.invulnerableTicks)
+		w.writeInt(a.hitAccumulator)
+		w.writeInt(a.ticksUntilSfx)
+		writeRef(w, a.target, refs)
+		if a.spawner != nil {
+			writeSpawner(w, a.spawner)
+		}
+	}
+}
+
+// decodeActor finds or creates the actor the host wrote, or returns nil.
+func (s *World) decodeActor(ctx states.Context, r *stateReader, links *[]func(actors []Actor)) Actor {
+	var a Actor
+	switch r.readInt() {
+	case joinActorPlayer:
+		slot := r.readInt()
+		if slot < 0 || slot >= len(s.Players) {
+			return nil
+		}
+		return s.Players[slot].Actor()
+	case joinActorSpawned:
+		i := r.readInt()
+		if i < 0 || i >= len(s.activeMap.spawned) {
+			return nil
+		}
+		a = s.activeMap.spawned[i]
+	case joinActorEnemy:
+		id := r.readString()
+		name := r.readString()
+		if r.err != nil {
+			return nil
+		}
+		a = CreateEnemy(ctx, s.simRNG, id, name)
+	}
+
+	switch a := a.(type) {
+	case *Interactive:
+		a.active = r.readBool()
+		a.hp = r.readInt()
+		a.activationIdx = r.readInt()
+		a.activateCooldown = r.readInt()
+		// The index picks the sprite's frame, so it must be one we have.
+		if a.activationIdx < 0 || (a.activationIdx > 0 && a.activationIdx >= len(a.inactiveSprite.Images())) {
+			r.err = ErrBadJoinState
+		}
+	case *Spawner:
+		readSpawner(r, a)
+	case *Snaggable:
+		a.SetXY(r.readFloat(), r.readFloat())
+		a.destroyed = r.readBool()
+		a.nextParticle = r.readInt()
+	case *Enemy:
+		a.SetXY(r.readFloat(), r.readFloat())
+		a.state = EnemyState(r.readInt())
+		a.wanderDir = r.readFloat()
+		a.rethinkTime = r.readInt()
+		a.health = r.readInt()
+		a.friendly = r.readBool()
+		a.hasDied = r.readBool()
+		a.invulnerableTicks = r.readInt()
+		a.hitAccumulator = r.readInt()
+		a.ticksUntilSfx = r.readInt()
+		target := r.readInt()
+		*links = append(*links, func(actors []Actor) {
+			a.target = actorAt(actors, target)
+		})
+		if a.spawner != nil {
+			readSpawner(r, a.spawner)
+		}
+	}
+	return a
+}
+
+// writePlayerActor writes a player's actor along with what it goes back to should the map be reset.
+func writePlayerActor(w *stateWriter, a Actor) {
+	switch a := a.(type) {
+	case *PC:
+		writePC(w, a)
+		w.writeBool(a.saved != nil)
+		if a.saved != nil {
+			writePC(w, a.saved)
+		}
+	case *Companion:
+		writeCompanion(w, a)
+		w.writeBool(a.saved != nil)
+		if a.saved != nil {
+			writeCompanion(w, a.saved)
+		}
+	}
+}
+
+// readPlayerActor reads back what writePlayerActor wrote.
+func readPlayerActor(r *stateReader, a Actor) {
+	switch a := a.(type) {
+	case *PC:
+		readPC(r, a)
+		a.saved = nil
+		if r.readBool() {
+			saved := *a
+			saved.saved = nil
+			readPC(r, &saved)
+			a.saved = &saved
+		}
+	case *Companion:
+		readCompanion(r, a)
+		a.saved = nil
+		if r.readBool() {
+			saved := *a
+			saved.saved = nil
+			readCompanion(r, &saved)
+			a.saved = &saved
+		}
+	}
+}
+
+func writePC(w *stateWriter, p *PC) {
+	w.writeFloat(p.shape.X)
+	w.writeFloat(p.shape.Y)
+	w.writeFloat(p.shape.Radius)
+	w.writeInt(p.Lives)
+	w.writeInt(p.InvulnerableTicks)
+	w.writeInt(p.TicksSinceLastInteraction)
+	w.writeInt(p.Energy)
+	w.writeInt(p.MaxEnergy)
+	w.writeInt(p.EnergyRestoreRate)
+	w.writeBool(p.HasDeflect)
+	w.writeBool(p.HasShield)
+	w.writeBool(p.shielding)
+	w.writeInt(interactionKind(p.previousInteraction))
+	w.writeBool(p.resurrected)
+	w.writeFloat(p.momentumX)
+	w.writeFloat(p.momentumY)
+}
+
+func readPC(r *stateReader, p *PC) {
+	p.SetXY(r.readFloat(), r.readFloat())
+	p.shape.Radius = r.readFloat()
+	p.Lives = r.readInt()
+	p.InvulnerableTicks = r.readInt()
+	p.TicksSinceLastInteraction = r.readInt()
+	p.Energy = r.readInt()
+	p.MaxEnergy = r.readInt()
+	p.EnergyRestoreRate = r.readInt()
+	p.HasDeflect = r.readBool()
+	p.HasShield = r.readBool()
+	p.shielding = r.readBool()
+	p.previousInteraction = interactionOfKind(r.readInt())
+	p.resurrected = r.readBool()
+	p.momentumX = r.readFloat()
+	p.momentumY = r.readFloat()
+}
+
+func writeCompanion(w *stateWriter, p *Companion) {
+	w.writeFloat(p.shape.X)
+	w.writeFloat(p.shape.Y)
+	w.writeFloat(p.shape.Radius)
+	w.writeInt(p.Energy)
+	w.writeInt(p.MaxEnergy)
+	w.writeInt(p.EnergyRestoreRate)
+	w.writeInt(p.snarfTicks)
+	w.writeInt(p.fireAllow)
+	w.writeInt(p.TicksSinceLastInteraction)
+	w.writeInt(interactionKind(p.previousInteraction))
+	w.writeFloat(p.momentumX)
+	w.writeFloat(p.momentumY)
+}
+
+func readCompanion(r *stateReader, p *Companion) {
+	p.SetXY(r.readFloat(), r.readFloat())
+	p.shape.Radius = r.readFloat()
+	p.Energy = r.readInt()
+	p.MaxEnergy = r.readInt()
+	p.EnergyRestoreRate = r.readInt()
+	p.snarfTicks = r.readInt()
+	p.fireAllow = r.readInt()
+	p.TicksSinceLastInteraction = r.readInt()
+	p.previousInteraction = interactionOfKind(r.readInt())
+	p.momentumX = r.readFloat()
+	p.momentumY = r.readFloat()
+}
+
+func interactionKind(a Action) int {
+	switch a.(type) {
+	case ActionReverse:
+		return joinInteractionReverse
+	case ActionDeflect:
+		return joinInteractionDeflect
+	case ActionShield:
+		return joinInteractionShield
+	case ActionSpawnBullets:
+		return joinInteractionShoot
+	}
+	return joinInteractionNone
+}
+
+func interactionOfKind(kind int) Action {
+	switch kind {
+	case joinInteractionReverse:
+		return ActionReverse{}
+	case joinInteractionDeflect:
+		return ActionDeflect{}
+	case joinInteractionShield:
+		return ActionShield{}
+	case joinInteractionShoot:
+		return ActionSpawnBullets{}
+	}
+	return nil
+}
+
+func writeSpawner(w *stateWriter, s *Spawner) {
+	w.writeFloat(s.shape.X)
+	w.writeFloat(s.shape.Y)
+	w.writeInt(len(s.bulletGroups))
+	for _, bg := range s.bulletGroups {
+		w.writeFloat(bg.X)
+		w.writeFloat(bg.Y)
+		w.writeInt(bg.lastSpawnedAt)
+		w.writeInt(bg.loopCount)
+	}
+}
+
+func readSpawner(r *stateReader, s *Spawner) {
+	s.shape.X = r.readFloat()
+	s.shape.Y = r.readFloat()
+	// The groups come from the same definitions on both sides, so only their progress is sent.
+	if r.readCount() != len(s.bulletGroups) {
+		r.err = ErrBadJoinState
+		return
+	}
+	for _, bg := range s.bulletGroups {
+		bg.SetXY(r.readFloat(), r.readFloat())
+		bg.lastSpawnedAt = r.readInt()
+		bg.loopCount = r.readInt()
+	}
+}
+
+func writeBullet(w *stateWriter, b *Bullet, refs map[Actor]int) {
+	w.writeString(string(b.bulletType))
+	w.writeColor(b.Color)
+	w.writeColor(b.borderColor)
+	w.writeFloat(b.Shape.X)
+	w.writeFloat(b.Shape.Y)
+	w.writeFloat(b.Shape.Radius)
+	w.writeFloat(b.Speed)
+	w.writeFloat(b.Angle)
+	w.writeFloat(b.Acceleration)
+	w.writeFloat(b.AccelAccel)
+	w.writeFloat(b.MinSpeed)
+	w.writeFloat(b.MaxSpeed)
+	w.writeFloat(b.AngularVelocity)
+	w.writeInt(b.aimDelay)
+	w.writeInt(b.aimTime)
+	w.writeBool(b.reversed)
+	w.writeBool(b.deflected)
+	w.writeBool(b.friendly)
+	w.writeInt(b.holdFor)
+	w.writeInt(b.nextParticle)
+	w.writeInt(b.Lifetime)
+	w.writeInt(b.Deathtime)
+	w.writeBool(b.Destroyed)
+	w.writeInt(b.Damage)
+	writeRef(w, b.TargetActor, refs)
+	// Only what reversing reads back of the timeline is kept.
+	w.writeInt(len(b.timeLine))
+	for _, t := range b.timeLine {
+		w.writeColor(t.borderColor)
+		w.writeFloat(t.Shape.X)
+		w.writeFloat(t.Shape.Y)
+		w.writeFloat(t.Speed)
+		w.writeFloat(t.Angle)
+		w.writeFloat(t.Acceleration)
+		w.writeFloat(t.AngularVelocity)
+		w.writeInt(t.aimDelay)
+		w.writeInt(t.aimTime)
+	}
+}
+
+func readBullet(r *stateReader, links *[]func(actors []Actor)) *Bullet {
+	bulletType := BulletType(r.readString())
+	clr := r.readColor()
+	borderColor := r.readColor()
+	x, y, radius := r.readFloat(), r.readFloat(), r.readFloat()
+	if r.err != nil {
+		return nil
+	}
+	b := CreateBullet(bulletType, clr, radius, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	b.borderColor = borderColor
+	b.SetXY(x, y)
+	b.Speed = r.readFloat()
+	b.Angle = r.readFloat()
+	b.Acceleration = r.readFloat()
+	b.AccelAccel = r.readFloat()
+	b.MinSpeed = r.readFloat()
+	b.MaxSpeed = r.readFloat()
+	b.AngularVelocity = r.readFloat()
+	b.aimDelay = r.readInt()
+	b.aimTime = r.readInt()
+	b.reversed = r.readBool()
+	b.deflected = r.readBool()
+	b.friendly = r.readBool()
+	b.holdFor = r.readInt()
+	b.nextParticle = r.readInt()
+	b.Lifetime = r.readInt()
+	b.Deathtime = r.readInt()
+	b.Destroyed = r.readBool()
+	b.Damage = r.readInt()
+	target := r.readInt()
+	*links = append(*links, func(actors []Actor) {
+		b.TargetActor = actorAt(actors, target)
+	})
+	b.timeLine = make([]*Bullet, r.readCount())
+	for i := range b.timeLine {
+		t := &Bullet{}
+		t.borderColor = r.readColor()
+		t.Shape.X = r.readFloat()
+		t.Shape.Y = r.readFloat()
+		t.Speed = r.readFloat()
+		t.Angle = r.readFloat()
+		t.Acceleration = r.readFloat()
+		t.AngularVelocity = r.readFloat()
+		t.aimDelay = r.readInt()
+		t.aimTime = r.readInt()
+		b.timeLine[i] = t
+	}
+	return b
+}
+
+// writeRef writes where an actor is in the map's actors, or -1 if it is nil or not there.
+func writeRef(w *stateWriter, a Actor, refs map[Actor]int) {
+	i, ok := refs[a]
+	if a == nil || !ok {
+		i = -1
+	}
+	w.writeInt(i)
+}
+
+// actorAt returns the actor a reference written by writeRef points to.
+func actorAt(actors []Actor, i int) Actor {
+	if i < 0 || i >= len(actors) {
+		return nil
+	}
+	return actors[i]
+}
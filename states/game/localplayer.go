@@ -13,13 +13,15 @@ import (
 type LocalPlayer struct {
 	connection     net.ServerClient // Only used if the player is a server.
 	actor          Actor
-	thoughts       Thoughts
+	thoughts       Thoughts // Thoughts the player has now, to be queued up for a coming tick.
+	tickThoughts   Thoughts // Thoughts as of the last tick applied.
 	thoughtReset   int
 	hasNewThoughts bool
 	impulses       ImpulseSet
-	queuedImpulses ImpulseSet
-	GamepadID      int    // Target gamepad for this player to use.
-	GamepadMap     string // Target mapping to use.
+	queued         map[int]tickInput // Input by the tick it applies on.
+	sentImpulses   ImpulseSet        // Impulses last sent to our peers, which unchanged impulses are sent as a repeat of.
+	GamepadID      int               // Target gamepad for this player to use.
+	GamepadMap     string            // Target mapping to use.
 	hat            string
 	// controller vars
 	cx, cy, ca, cd  float64
@@ -29,7 +31,7 @@ type LocalPlayer struct {
 func NewLocalPlayer() *LocalPlayer {
 	return &LocalPlayer{
 		impulses:        ImpulseSet{},
-		queuedImpulses:  ImpulseSet{},
+		queued:          make(map[int]tickInput),
 		GamepadID:       -1,
 		ca:              math.Pi / 2,
 		cd:              40.0,
@@ -209,11 +211,13 @@ func (p *LocalPlayer) Update() {
 }
 
 // Tick is called on actual world tick.
-func (p *LocalPlayer) Tick() {
+func (p *LocalPlayer) Tick(tick int) {
+	input := p.queued[tick]
 	if p.actor != nil {
-		p.actor.SetImpulses(p.queuedImpulses)
-		p.queuedImpulses = ImpulseSet{}
+		p.actor.SetImpulses(input.impulses)
 	}
+	p.tickThoughts = input.thoughts
+	delete(p.queued, tick-inputsKept)
 }
 
 // Impulses is a list of impulses that the player currently desires their actor to process.
@@ -221,8 +225,9 @@ func (p *LocalPlayer) Impulses() ImpulseSet {
 	return p.impulses
 }
 
-func (p *LocalPlayer) QueueImpulses(impulses ImpulseSet) {
-	p.queuedImpulses = impulses
+// QueueInput sets the impulses and thoughts to apply on the given tick.
+func (p *LocalPlayer) QueueInput(tick int, impulses ImpulseSet, thoughts Thoughts) {
+	p.queued[tick] = tickInput{impulses: impulses, thoughts: thoughts}
 }
 
 func (p *LocalPlayer) ClearImpulses() {
@@ -230,7 +235,7 @@ func (p *LocalPlayer) ClearImpulses() {
 }
 
 func (p *LocalPlayer) Thoughts() Thoughts {
-	return p.thoughts
+	return p.tickThoughts
 }
 
 func (p *LocalPlayer) Ready(nextTick int) bool {
@@ -29,6 +29,7 @@ type Map struct {
 	actors       []Actor
 	interactives []*Interactive
 	enemies      []*Enemy
+	spawned      []Actor // Actor created for each of the map's actors, so they can be found again by index.
 	bullets      []*Bullet
 	conditions   []*resources.ConditionDef
 	cleared      bool
@@ -114,7 +115,8 @@ func (s *World) TravelToMap(ctx states.Context, mapName string) error {
 	// Create actors.
 	// Create map of actor IDs to actors
 	interactiveMap := make(map[string]*Interactive)
-	for _, a := range m.data.Actors {
+	m.spawned = make([]Actor, len(m.data.Actors))
+	for i, a := range m.data.Actors {
 		cell := m.FindCellById(a.ID)
 
 		// We're either using the spawn location ("spawn" property on actor)
@@ -145,22 +147,26 @@ func (s *World) TravelToMap(ctx states.Context, mapName string) error {
 			}
 
 			m.actors = append(m.actors, interactive)
+			m.spawned[i] = interactive
 			m.interactives = append(m.interactives, interactive)
 		case "spawner":
-			spawner := CreateSpawner(ctx, a.BulletGroups)
+			spawner := CreateSpawner(ctx, s.simRNG, a.BulletGroups)
 			spawner.SetXY(x, y)
 
 			m.actors = append(m.actors, spawner)
+			m.spawned[i] = spawner
 		case "snaggable":
 			snaggable := CreateSnaggable(ctx, a.ID, a.Sprite)
 			snaggable.SetXY(x, y)
 
 			m.actors = append(m.actors, snaggable)
+			m.spawned[i] = snaggable
 		case "enemy":
-			enemy := CreateEnemy(ctx, a.ID, a.Sprite)
+			enemy := CreateEnemy(ctx, s.simRNG, a.ID, a.Sprite)
 			enemy.SetXY(x, y+4) // +4 makes it so they don't get stuck...
 
 			m.actors = append(m.actors, enemy)
+			m.spawned[i] = enemy
 			m.enemies = append(m.enemies, enemy)
 		}
 	}
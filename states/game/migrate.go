@@ -0,0 +1,182 @@
+package game
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ketMix/retromancer/net"
+)
+
+func init() {
+	net.RegisterMessage(PlayerLeft{})
+}
+
+// PlayerLeft settles the last tick a player who left with the old host has impulses for.
+type PlayerLeft struct {
+	Slot uint8
+	Tick uint32
+}
+
+func (m PlayerLeft) Ident() uint8 {
+	return 28
+}
+
+func (m PlayerLeft) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = append(b, m.Slot)
+	b = binary.LittleEndian.AppendUint32(b, m.Tick)
+	return
+}
+
+func (m PlayerLeft) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 6 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Slot = b[1]
+	m.Tick = binary.LittleEndian.Uint32(b[2:])
+	return m, 6, nil
+}
+
+// HandleHostMigrated gets ready to carry on with a new host.
+func (s *World) HandleHostMigrated(e net.EventHostMigrated) {
+	s.newHost = e.ID
+	s.leftReports = make(map[uint32]bool)
+	for _, player := range s.PlayersFromPeer(e.OldPeer) {
+		player.peer = nil
+		if player.owner == e.OldPeer.ID() {
+			// There is nothing to wait for from a host that is gone, however it went.
+			player.departed = true
+			player.timedOut = false
+			player.reconnecting = false
+		} else {
+			player.timedOut = true
+			player.reconnecting = true
+		}
+	}
+	if s.Net.Hosting {
+		s.checkLeftReports()
+	}
+}
+
+// HandleMigrationConnect picks up the players waiting on a peer that arrived since the host changed.
+func (s *World) HandleMigrationConnect(peer *net.Peer) {
+	if s.newHost == 0 {
+		return
+	}
+	after := -1
+	for _, player := range s.Players {
+		remote, ok := player.(*RemotePlayer)
+		if !ok {
+			continue
+		}
+		if remote.peer == nil && !remote.departed && (remote.owner == peer.ID() || (!s.Net.Hosting && peer.ID() == s.newHost)) {
+			remote.peer = peer
+			remote.timedOut = false
+			remote.reconnecting = false
+		}
+		if (remote.peer == peer || (remote.departed && !remote.left)) && (after == -1 || remote.lastTick < after) {
+			after = remote.lastTick
+		}
+	}
+	if after >= 0 && !peer.Spectator() {
+		peer.Send(TickRequest{After: uint32(after)})
+	}
+
+	if !s.Net.Hosting {
+		s.reportLeft(peer)
+	} else {
+		s.sendLeft(peer)
+	}
+}
+
+// HandleMigrationFailed stops waiting on players we could not reach after the host changed.
+func (s *World) HandleMigrationFailed() {
+	for _, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && remote.peer == nil && !remote.departed {
+			remote.reconnecting = false
+		}
+	}
+}
+
+// HandlePlayerLeft takes a report of how far someone got with a departed player.
+func (s *World) HandlePlayerLeft(peer *net.Peer, msg PlayerLeft) {
+	if int(msg.Slot) >= len(s.Players) {
+		return
+	}
+	player, ok := s.Players[msg.Slot].(*RemotePlayer)
+	if !ok || !player.departed || player.left {
+		return
+	}
+	if !s.Net.Hosting {
+		s.leave(player, int(msg.Tick))
+		return
+	}
+	s.leftReports[peer.ID()] = true
+	s.checkLeftReports()
+}
+
+// reportLeft sends the new host what we have of the departed players.
+func (s *World) reportLeft(peer *net.Peer) {
+	for i, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && remote.departed && !remote.left {
+			for _, state := range s.tickHistory {
+				if int(state.Slot) == i {
+					peer.Queue(state)
+				}
+			}
+			peer.Queue(PlayerLeft{Slot: uint8(i), Tick: uint32(remote.lastTick)})
+		}
+	}
+	peer.Flush()
+}
+
+// sendLeft sends a peer what we have of the players that have left, followed by where each stops.
+func (s *World) sendLeft(peer *net.Peer) {
+	for i, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && remote.left {
+			for _, state := range s.tickHistory {
+				if int(state.Slot) == i {
+					peer.Queue(state)
+				}
+			}
+			peer.Queue(PlayerLeft{Slot: uint8(i), Tick: uint32(remote.lastTick)})
+		}
+	}
+	peer.Flush()
+}
+
+// checkLeftReports settles where the departed players stop once everyone has reported.
+func (s *World) checkLeftReports() {
+	for _, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && !remote.departed && !s.leftReports[remote.owner] {
+			return
+		}
+	}
+	settled := false
+	for _, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && remote.departed && !remote.left {
+			s.leave(remote, remote.lastTick)
+			settled = true
+		}
+	}
+	if !settled {
+		return
+	}
+	for _, peer := range s.TickPeers() {
+		s.sendLeft(peer)
+	}
+}
+
+// leave stops a departed player after the given tick.
+func (s *World) leave(player *RemotePlayer, tick int) {
+	if player.lastTick < tick {
+		fmt.Println("departed player is missing ticks up to", tick)
+	}
+	for t := range player.queued {
+		if t > tick {
+			delete(player.queued, t)
+		}
+	}
+	player.lastTick = tick
+	player.left = true
+}
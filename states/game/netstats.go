@@ -0,0 +1,75 @@
+package game
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/ketMix/retromancer/net"
+	"github.com/ketMix/retromancer/resources"
+	"github.com/ketMix/retromancer/states"
+	"github.com/tinne26/etxt"
+)
+
+// NetStatsKey toggles the network stats overlay while in networked play.
+var NetStatsKey = ebiten.KeyF3
+
+// NetShowStats is whether the network stats overlay starts shown.
+var NetShowStats = false
+
+// updateNetStats toggles the network stats overlay.
+func (s *World) updateNetStats(chatting bool) {
+	if s.Net.Running && !chatting && inpututil.IsKeyJustPressed(NetStatsKey) {
+		NetShowStats = !NetShowStats
+	}
+}
+
+// netStatsLines describes how the connection to each peer is doing.
+func (s *World) netStatsLines(ctx states.DrawContext) (lines []string) {
+	kcp := net.GetKCPStats()
+	lines = append(lines, fmt.Sprintf("tick %d  resent %d  lost %d", s.tick, kcp.Retransmits, kcp.Lost))
+	for _, peer := range s.Net.Peers() {
+		stats := peer.Stats()
+		var names []string
+		gap, hasGap := 0, false
+		for i, player := range s.Players {
+			if remote, ok := player.(*RemotePlayer); ok && remote.Peer() == peer {
+				names = append(names, fmt.Sprintf("P%d", i+1))
+				if g := remote.lastTick - s.tick; !hasGap || g < gap {
+					gap, hasGap = g, true
+				}
+			}
+		}
+		name := strings.Join(names, ",")
+		if peer.Spectator() {
+			name = ctx.L.Get("Spectator")
+		} else if name == "" {
+			name = ctx.L.Get("Host")
+		}
+		line := fmt.Sprintf("%s  rtt %dms  loss %.0f%%  in %.1fKB/s  out %.1fKB/s", name, stats.RTT.Milliseconds(), stats.Loss*100, stats.InRate/1024, stats.OutRate/1024)
+		if hasGap {
+			line += fmt.Sprintf("  gap %+d", gap)
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+func (s *World) drawNetStats(ctx states.DrawContext) {
+	if !s.Net.Running || !NetShowStats {
+		return
+	}
+	ctx.Text.SetAlign(etxt.Top | etxt.Right)
+	ctx.Text.SetScale(1.0)
+	x := ctx.Screen.Bounds().Max.X - 8
+	y := 8.0
+	for _, line := range s.netStatsLines(ctx) {
+		ctx.Text.SetColor(color.Black)
+		resources.DrawTextOutline(ctx.Text, ctx.Screen, line, x, int(y), 1)
+		ctx.Text.SetColor(color.White)
+		ctx.Text.Draw(ctx.Screen, line, x, int(y))
+		y += ctx.Text.Utils().GetLineHeight()
+	}
+}
@@ -1,5 +1,22 @@
 package game
 
+// MaxPlayers is the most players a single game can have, local and remote combined.
+const MaxPlayers = 4
+
+// IsPCSlot returns if the player at the given index in World.Players controls a PC.
+func IsPCSlot(slot int) bool {
+	return slot%2 == 0
+}
+
+// inputsKept is how many ticks of input a player keeps for rolling back.
+const inputsKept = 64
+
+// tickInput is what a player does on a tick.
+type tickInput struct {
+	impulses ImpulseSet
+	thoughts Thoughts
+}
+
 // Player represents either a local or remote player.
 type Player interface {
 	// ???
@@ -7,12 +24,12 @@ type Player interface {
 	SetActor(actor Actor)
 	Actor() Actor
 	Update()
-	Tick()
+	Tick(tick int)
 	Impulses() ImpulseSet
 	ClearImpulses()
-	QueueImpulses(impulses ImpulseSet)
+	QueueInput(tick int, impulses ImpulseSet, thoughts Thoughts)
 	//
-	Thoughts() Thoughts
+	Thoughts() Thoughts // Thoughts as of the last tick applied.
 	//
 	SetHat(string)
 	Hat() string
@@ -6,40 +6,56 @@ import (
 
 // RemotePlayer is a networked player.
 type RemotePlayer struct {
-	peer           *net.Peer
-	lastTick       int
-	actor          Actor
-	impulses       ImpulseSet
-	queuedImpulses ImpulseSet
-	thoughts       Thoughts
-	hat            string
+	peer         *net.Peer
+	lastTick     int // Last tick we have impulses for.
+	actor        Actor
+	impulses     ImpulseSet
+	queued       map[int]tickInput // Input by the tick it applies on.
+	early        map[int]TickState // TickStates that arrived ahead of those before them, by tick.
+	thoughts     Thoughts          // Thoughts as of the last tick applied.
+	hat          string
+	timedOut     bool   // Set while we have not heard from the peer for too long.
+	reconnecting bool   // Set once we have asked to wait for the peer again.
+	owner        uint32 // ID of the computer the player is on.
+	departed     bool   // Set once the player's computer has left the game for good. Until the host decides the last tick they have impulses for, they may come from anyone.
+	left         bool   // Set once the host has decided the departed player's last tick. The player stands idle from then on.
 }
 
 func NewRemotePlayer(peer *net.Peer) *RemotePlayer {
 	return &RemotePlayer{
-		peer:           peer,
-		impulses:       ImpulseSet{},
-		queuedImpulses: ImpulseSet{},
-		hat:            "hat-",
+		peer:     peer,
+		impulses: ImpulseSet{},
+		queued:   make(map[int]tickInput),
+		early:    make(map[int]TickState),
+		hat:      "hat-",
 	}
 }
 
 func (p *RemotePlayer) Update() {
 }
 
-func (p *RemotePlayer) Tick() {
+// Tick applies the player's input for the given tick, or predicts it if it hasn't arrived.
+func (p *RemotePlayer) Tick(tick int) {
+	input, ok := p.queued[tick]
+	if p.left && tick > p.lastTick {
+		input = tickInput{}
+	} else if !ok && tick > p.lastTick {
+		input = tickInput{impulses: p.queued[p.lastTick].impulses}
+	}
 	if p.actor != nil {
-		p.actor.SetImpulses(p.queuedImpulses)
-		p.queuedImpulses = ImpulseSet{}
+		p.actor.SetImpulses(input.impulses)
 	}
+	p.thoughts = input.thoughts
+	delete(p.queued, tick-inputsKept)
 }
 
 func (p *RemotePlayer) Impulses() ImpulseSet {
 	return p.impulses
 }
 
-func (p *RemotePlayer) QueueImpulses(impulses ImpulseSet) {
-	p.queuedImpulses = impulses
+// QueueInput sets the impulses and thoughts to apply on the given tick.
+func (p *RemotePlayer) QueueInput(tick int, impulses ImpulseSet, thoughts Thoughts) {
+	p.queued[tick] = tickInput{impulses: impulses, thoughts: thoughts}
 }
 
 func (p *RemotePlayer) ClearImpulses() {
@@ -51,7 +67,7 @@ func (p *RemotePlayer) Thoughts() Thoughts {
 }
 
 func (p *RemotePlayer) Ready(nextTick int) bool {
-	return p.lastTick == nextTick-1
+	return p.left || p.lastTick >= nextTick
 }
 
 func (p *RemotePlayer) Actor() Actor {
@@ -75,6 +91,20 @@ func (p *RemotePlayer) Peer() *net.Peer {
 	return p.peer
 }
 
+// SetPeer moves the player over to a new peer, such as after reconnecting.
+func (p *RemotePlayer) SetPeer(peer *net.Peer) {
+	p.peer = peer
+}
+
+func (p *RemotePlayer) Owner() uint32 {
+	return p.owner
+}
+
+// SetOwner sets the ID of the computer the player is on.
+func (p *RemotePlayer) SetOwner(owner uint32) {
+	p.owner = owner
+}
+
 func (s *World) PlayerFromPeer(peer *net.Peer) *RemotePlayer {
 	for _, player := range s.Players {
 		if player, ok := player.(*RemotePlayer); ok && player.Peer() == peer {
@@ -83,3 +113,53 @@ func (s *World) PlayerFromPeer(peer *net.Peer) *RemotePlayer {
 	}
 	return nil
 }
+
+// PlayersFromPeer returns every remote player reached through the given peer.
+func (s *World) PlayersFromPeer(peer *net.Peer) (players []*RemotePlayer) {
+	for _, player := range s.Players {
+		if player, ok := player.(*RemotePlayer); ok && player.Peer() == peer {
+			players = append(players, player)
+		}
+	}
+	return
+}
+
+// RemotePeers returns each peer we have remote players through, once.
+func (s *World) RemotePeers() (peers []*net.Peer) {
+	for _, player := range s.Players {
+		if player, ok := player.(*RemotePlayer); ok && player.Peer() != nil {
+			found := false
+			for _, p := range peers {
+				if p == player.Peer() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				peers = append(peers, player.Peer())
+			}
+		}
+	}
+	return
+}
+
+// TickPeers returns every peer our TickStates go to.
+func (s *World) TickPeers() []*net.Peer {
+	peers := s.RemotePeers()
+	if !s.Net.Hosting {
+		return peers
+	}
+next:
+	for _, p := range s.Net.Peers() {
+		if p.Rejected() || (p.Spectator() && p.TimedOut()) {
+			continue
+		}
+		for _, peer := range peers {
+			if peer == p {
+				continue next
+			}
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
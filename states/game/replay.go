@@ -0,0 +1,368 @@
+package game
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ketMix/retromancer/net"
+	"github.com/ketMix/retromancer/states"
+)
+
+func init() {
+	net.RegisterMessage(IntroEnd{})
+}
+
+// RecordReplay is the file games are recorded to. Left empty, nothing is recorded.
+var RecordReplay string
+
+var (
+	ErrBadReplay     = errors.New("not a replay")
+	ErrReplayVersion = errors.New("replay is from a different version of the game")
+	ErrReplayAssets  = errors.New("replay was recorded with different assets")
+	replayMagic      = []byte("RMRP")
+)
+
+// IntroEnd marks the tick the intro ended on in a replay.
+type IntroEnd struct {
+	Tick uint32
+}
+
+func (m IntroEnd) Ident() uint8 {
+	return 39
+}
+
+func (m IntroEnd) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = binary.LittleEndian.AppendUint32(b, m.Tick)
+	return
+}
+
+func (m IntroEnd) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 5 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Tick = binary.LittleEndian.Uint32(b[1:])
+	return m, 5, nil
+}
+
+// ReplayHeader is what a replay's stream of TickStates starts from.
+type ReplayHeader struct {
+	Version     uint16 // NetProtocolVersion, as the stream is made of the same messages peers send.
+	Fingerprint uint64 // NetFingerprint of the assets the game was played with.
+	Seed        int64
+	Difficulty  string
+	StartingMap string
+	Hats        []string // Hat of each player the game began with, in slot order.
+}
+
+func (h ReplayHeader) ToBytes() (b []byte) {
+	b = append(b, replayMagic...)
+	b = binary.LittleEndian.AppendUint16(b, h.Version)
+	b = binary.LittleEndian.AppendUint64(b, h.Fingerprint)
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.Seed))
+	b = net.AppendString(b, h.Difficulty)
+	b = net.AppendString(b, h.StartingMap)
+	b = append(b, uint8(len(h.Hats)))
+	for _, hat := range h.Hats {
+		b = net.AppendString(b, hat)
+	}
+	return
+}
+
+// FromBytes reads a header written by ToBytes, returning how many bytes it took up.
+func (h ReplayHeader) FromBytes(b []byte) (ReplayHeader, int, error) {
+	offset := len(replayMagic)
+	if len(b) < offset+18 || string(b[:offset]) != string(replayMagic) {
+		return h, 0, ErrBadReplay
+	}
+	h.Version = binary.LittleEndian.Uint16(b[offset:])
+	h.Fingerprint = binary.LittleEndian.Uint64(b[offset+2:])
+	h.Seed = int64(binary.LittleEndian.Uint64(b[offset+10:]))
+	offset += 18
+
+	var n int
+	if h.Difficulty, n = net.ReadString(b[offset:]); n < 0 {
+		return h, 0, ErrBadReplay
+	}
+	offset += n
+	if h.StartingMap, n = net.ReadString(b[offset:]); n < 0 {
+		return h, 0, ErrBadReplay
+	}
+	offset += n
+	if len(b) < offset+1 {
+		return h, 0, ErrBadReplay
+	}
+	count := int(b[offset])
+	offset++
+	h.Hats = nil
+	for i := 0; i < count; i++ {
+		hat, n := net.ReadString(b[offset:])
+		if n < 0 {
+			return h, 0, ErrBadReplay
+		}
+		h.Hats = append(h.Hats, hat)
+		offset += n
+	}
+	return h, offset, nil
+}
+
+// Replay is a recorded game, ready to be played back by a World.
+type Replay struct {
+	Header   ReplayHeader
+	players  []*ReplayPlayer // The players the game began with.
+	joins    []pendingJoin   // Players that dropped in later.
+	introEnd int             // Tick the intro ended on.
+}
+
+// ReadReplay reads a replay recorded by a World.
+func ReadReplay(r io.Reader) (*Replay, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	header, offset, err := ReplayHeader{}.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != net.NetProtocolVersion {
+		return nil, ErrReplayVersion
+	}
+	if header.Fingerprint != net.NetFingerprint {
+		return nil, ErrReplayAssets
+	}
+
+	replay := &Replay{Header: header}
+	var slots []*ReplayPlayer
+	for _, hat := range header.Hats {
+		player := NewReplayPlayer(hat)
+		replay.players = append(replay.players, player)
+		slots = append(slots, player)
+	}
+
+	for offset < len(b) {
+		size, n := binary.Uvarint(b[offset:])
+		if n <= 0 || uint64(len(b)-offset-n) < size {
+			return nil, ErrBadReplay
+		}
+		frame := b[offset+n : offset+n+int(size)]
+		offset += n + int(size)
+
+		msg, _, err := net.MessageFromBytes(frame)
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case TickState:
+			if int(msg.Slot) >= len(slots) {
+				return nil, ErrBadReplay
+			}
+			slots[msg.Slot].record(int(msg.Tick), msg)
+		case PlayerJoined:
+			join := pendingJoin{tick: int(msg.Tick)}
+			for _, hat := range msg.Hats {
+				player := NewReplayPlayer(hat)
+				join.players = append(join.players, player)
+				slots = append(slots, player)
+			}
+			replay.joins = append(replay.joins, join)
+		case IntroEnd:
+			replay.introEnd = int(msg.Tick)
+		default:
+			return nil, ErrBadReplay
+		}
+	}
+	return replay, nil
+}
+
+// ReplayPlayer is a player from a replay.
+type ReplayPlayer struct {
+	actor    Actor
+	hat      string
+	ticks    map[int]tickInput
+	lastTick int // Last tick recorded.
+	thoughts Thoughts
+}
+
+func NewReplayPlayer(hat string) *ReplayPlayer {
+	return &ReplayPlayer{
+		hat:   hat,
+		ticks: make(map[int]tickInput),
+	}
+}
+
+// record keeps what the player did on a tick of the replay being read.
+func (p *ReplayPlayer) record(tick int, state TickState) {
+	if state.Repeat {
+		state.Impulses = p.ticks[p.lastTick].impulses
+	}
+	p.ticks[tick] = tickInput{impulses: state.Impulses, thoughts: state.Thoughts}
+	p.lastTick = tick
+}
+
+func (p *ReplayPlayer) Update() {
+}
+
+// Tick applies what the player did on the given tick.
+func (p *ReplayPlayer) Tick(tick int) {
+	t := p.ticks[tick]
+	if p.actor != nil {
+		p.actor.SetImpulses(t.impulses)
+	}
+	p.thoughts = t.thoughts
+	delete(p.ticks, tick)
+}
+
+func (p *ReplayPlayer) Impulses() ImpulseSet {
+	return ImpulseSet{}
+}
+
+func (p *ReplayPlayer) ClearImpulses() {
+}
+
+// QueueInput does nothing, as a replay player only ever does what was recorded.
+func (p *ReplayPlayer) QueueInput(tick int, impulses ImpulseSet, thoughts Thoughts) {
+}
+
+func (p *ReplayPlayer) Thoughts() Thoughts {
+	return p.thoughts
+}
+
+func (p *ReplayPlayer) Ready(nextTick int) bool {
+	return true
+}
+
+func (p *ReplayPlayer) Actor() Actor {
+	return p.actor
+}
+
+func (p *ReplayPlayer) SetActor(actor Actor) {
+	p.actor = actor
+	actor.SetPlayer(p)
+}
+
+func (p *ReplayPlayer) Hat() string {
+	return p.hat
+}
+
+func (p *ReplayPlayer) SetHat(hat string) {
+	p.hat = hat
+}
+
+// replayRecorder writes a game's impulse stream to a replay file as its ticks are settled.
+type replayRecorder struct {
+	file     *os.File
+	buf      []byte
+	recorded []ImpulseSet // What each slot last recorded, which unchanged impulses are recorded as a repeat of.
+	intro    bool         // Whether the intro was still on as of the last recorded tick.
+}
+
+// queue frames a message the same way peers do, to be written with the rest of the tick.
+func (r *replayRecorder) queue(msg net.Message) {
+	b := msg.ToBytes()
+	r.buf = binary.AppendUvarint(r.buf, uint64(len(b)))
+	r.buf = append(r.buf, b...)
+}
+
+// startRecording begins recording the game to RecordReplay.
+func (s *World) startRecording(difficulty string) error {
+	file, err := os.Create(RecordReplay)
+	if err != nil {
+		return err
+	}
+	header := ReplayHeader{
+		Version:     net.NetProtocolVersion,
+		Fingerprint: net.NetFingerprint,
+		Seed:        s.Seed,
+		Difficulty:  difficulty,
+		StartingMap: s.StartingMap,
+	}
+	for _, p := range s.Players {
+		header.Hats = append(header.Hats, p.Hat())
+	}
+	if _, err := file.Write(header.ToBytes()); err != nil {
+		file.Close()
+		return err
+	}
+	_, intro := s.CurrentState().(*WorldStateBegin)
+	s.recorder = &replayRecorder{
+		file:     file,
+		recorded: make([]ImpulseSet, len(s.Players)),
+		intro:    intro,
+	}
+	return nil
+}
+
+// recordReplay adds what everyone did on the tick to the replay once it is confirmed.
+func (s *World) recordReplay(tick int) {
+	r := s.recorder
+	if r == nil || tick > s.confirmedTick() {
+		return
+	}
+	if _, intro := s.CurrentState().(*WorldStateBegin); r.intro && !intro {
+		r.queue(IntroEnd{Tick: uint32(tick - 1)})
+		r.intro = false
+	}
+	if len(s.Players) > len(r.recorded) {
+		var msg PlayerJoined
+		msg.Tick = uint32(tick)
+		for _, p := range s.Players[len(r.recorded):] {
+			msg.Hats = append(msg.Hats, p.Hat())
+			r.recorded = append(r.recorded, ImpulseSet{})
+		}
+		r.queue(msg)
+	}
+	for i, p := range s.Players {
+		impulses := appliedImpulses(p.Actor())
+		r.queue(TickState{
+			Tick:     uint32(tick),
+			Slot:     uint8(i),
+			Repeat:   impulses.Equal(r.recorded[i]),
+			Thoughts: p.Thoughts(),
+			Impulses: impulses,
+		})
+		r.recorded[i] = impulses
+	}
+	_, err := r.file.Write(r.buf)
+	r.buf = r.buf[:0]
+	if err != nil {
+		fmt.Println("stopped recording replay:", err)
+		s.stopRecording()
+	}
+}
+
+// stopRecording closes the replay being recorded, if any.
+func (s *World) stopRecording() {
+	if s.recorder == nil {
+		return
+	}
+	s.recorder.file.Close()
+	s.recorder = nil
+}
+
+// startReplay takes the players and settings of the game from the replay being played back.
+func (s *World) startReplay() {
+	header := s.Replay.Header
+	s.Players = nil
+	for _, p := range s.Replay.players {
+		s.Players = append(s.Players, p)
+	}
+	s.joins = append(s.joins, s.Replay.joins...)
+	s.StartingMap = header.StartingMap
+	s.Seed = header.Seed
+	difficulty := states.Difficulty(header.Difficulty)
+	s.Difficulty = &difficulty
+}
+
+// appliedImpulses returns the impulses an actor was last given.
+func appliedImpulses(a Actor) ImpulseSet {
+	switch a := a.(type) {
+	case *PC:
+		return a.impulses
+	case *Companion:
+		return a.impulses
+	}
+	return ImpulseSet{}
+}
@@ -0,0 +1,26 @@
+package game
+
+// simSource is the source behind a world's simRNG.
+type simSource struct {
+	state uint64
+	draws uint64 // How many numbers have been drawn, to make desync dumps easier to follow.
+}
+
+// Uint64 is splitmix64.
+func (s *simSource) Uint64() uint64 {
+	s.draws++
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *simSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *simSource) Seed(seed int64) {
+	s.state = uint64(seed)
+	s.draws = 0
+}
@@ -0,0 +1,86 @@
+package game
+
+import (
+	"math"
+
+	"github.com/ketMix/retromancer/resources"
+	"github.com/ketMix/retromancer/states"
+)
+
+// NetInputDelay is how many ticks local impulses are delayed by in networked play.
+var NetInputDelay = 2
+
+// NetRollback is how many ticks we may guess ahead of remote players. 0 disables rollback.
+var NetRollback = 0
+
+// inputDelay returns how many ticks local impulses are delayed by.
+func (s *World) inputDelay() int {
+	if !s.Net.Running || s.InputDelay < 1 {
+		return 1
+	}
+	return s.InputDelay
+}
+
+// rollbackTicks returns how many ticks we may guess ahead.
+func (s *World) rollbackTicks() int {
+	if !s.Net.Running || NetRollback < 0 {
+		return 0
+	}
+	if NetRollback > inputsKept/2 {
+		return inputsKept / 2
+	}
+	return NetRollback
+}
+
+// confirmedTick returns the last tick we have every player's impulses for.
+func (s *World) confirmedTick() int {
+	confirmed := math.MaxInt
+	for _, player := range s.Players {
+		if remote, ok := player.(*RemotePlayer); ok && !remote.left && remote.lastTick < confirmed {
+			confirmed = remote.lastTick
+		}
+	}
+	return confirmed
+}
+
+// canTick returns whether the given tick can be processed.
+func (s *World) canTick(tick int) bool {
+	ready := true
+	for _, player := range s.Players {
+		if !player.Ready(tick) {
+			ready = false
+		}
+	}
+	if ready {
+		return true
+	}
+	return tick-s.confirmedTick() <= s.rollbackTicks()
+}
+
+// rollback rewinds to the snapshot and simulates forward again.
+func (s *World) rollback(ctx states.Context) {
+	if s.snapshot == nil {
+		return
+	}
+	confirmed := s.confirmedTick()
+	if confirmed <= s.snapshot.tick {
+		return
+	}
+	target := s.tick
+
+	// Don't replay the sounds of ticks we have already heard.
+	volume := resources.Volume
+	resources.Volume = 0
+	defer func() {
+		resources.Volume = volume
+	}()
+
+	s.restoreSnapshot(s.snapshot)
+	s.snapshot = nil
+	for s.tick < target {
+		if s.snapshot == nil && confirmed < s.tick+1 {
+			s.snapshot = s.takeSnapshot()
+		}
+		s.step(ctx)
+	}
+}
@@ -63,8 +63,8 @@ func (s *Snaggable) Update() (actions []Action) {
 			Img:   img,
 			X:     s.shape.X,
 			Y:     s.shape.Y,
-			Angle: math.Pi + rng.Float64()*math.Pi,
-			Speed: rng.Float64() * 0.5,
+			Angle: math.Pi + fxRNG.Float64()*math.Pi,
+			Speed: fxRNG.Float64() * 0.5,
 			Life:  40,
 		})
 		s.nextParticle = -10
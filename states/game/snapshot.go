@@ -0,0 +1,371 @@
+package game
+
+import (
+	"github.com/ketMix/retromancer/resources"
+)
+
+// worldSnapshot is everything the simulation touches, kept for rolling back.
+type worldSnapshot struct {
+	tick      int
+	rng       simSource
+	states    []WorldState
+	savedNPCs map[string]bool
+	activeMap *Map
+	mapState  *mapSnapshot
+	players   []Actor         // The players' actors, in the order of World.Players.
+	actors    []actorSnapshot // The players' actors as they were, along with every actor in the map.
+}
+
+// takeSnapshot copies the world as it is now.
+func (s *World) takeSnapshot() *worldSnapshot {
+	snap := &worldSnapshot{
+		tick:      s.tick,
+		rng:       s.rng,
+		states:    append([]WorldState(nil), s.states...),
+		savedNPCs: make(map[string]bool, len(s.savedNPCs)),
+		activeMap: s.activeMap,
+		players:   make([]Actor, len(s.Players)),
+	}
+	for npc := range s.savedNPCs {
+		snap.savedNPCs[npc] = true
+	}
+
+	// Players' actors are taken on their own, as they may have dropped out of the map's actors.
+	seen := make(map[Actor]bool)
+	for i, p := range s.Players {
+		snap.players[i] = p.Actor()
+		snap.addActor(p.Actor(), seen)
+	}
+	if m := s.activeMap; m != nil {
+		snap.mapState = m.snapshot()
+		for _, a := range m.actors {
+			snap.addActor(a, seen)
+		}
+		// Destroyed enemies drop out of the map's actors, but are still counted by the map's conditions.
+		for _, e := range m.enemies {
+			snap.addActor(e, seen)
+		}
+	}
+	return snap
+}
+
+// addActor takes a snapshot of the actor, unless it has already been taken.
+func (snap *worldSnapshot) addActor(a Actor, seen map[Actor]bool) {
+	if a == nil || seen[a] {
+		return
+	}
+	seen[a] = true
+	var state actorSnapshot
+	switch a := a.(type) {
+	case *PC:
+		state = a.snapshot()
+	case *Companion:
+		state = a.snapshot()
+	case *Interactive:
+		state = a.snapshot()
+	case *Spawner:
+		state = a.snapshot()
+	case *Snaggable:
+		state = a.snapshot()
+	case *Enemy:
+		state = a.snapshot()
+	default:
+		return
+	}
+	snap.actors = append(snap.actors, state)
+}
+
+// restoreSnapshot puts the world back the way it was. The snapshot is used up by this.
+func (s *World) restoreSnapshot(snap *worldSnapshot) {
+	s.tick = snap.tick
+	s.rng = snap.rng
+	s.states = snap.states
+	s.savedNPCs = snap.savedNPCs
+	// Travelling to another map leaves the old one as it was, so it only needs bringing back.
+	s.activeMap = snap.activeMap
+	if snap.mapState != nil {
+		snap.mapState.restore()
+	}
+	for _, a := range snap.actors {
+		a.restore()
+	}
+	// Anyone who joined since is added again when their tick comes around.
+	s.Players = s.Players[:len(snap.players)]
+	for i, p := range s.Players {
+		if snap.players[i] != nil {
+			p.SetActor(snap.players[i])
+		}
+	}
+}
+
+// mapSnapshot is what of a map changes as it is played.
+type mapSnapshot struct {
+	m         *Map
+	actors    []Actor
+	enemies   []*Enemy
+	bullets   []bulletSnapshot
+	particles []Particle
+	cells     []cellSnapshot // Every cell, layer by layer and row by row.
+	cleared   bool
+	currentZ  int
+	vfx       resources.VFXList
+}
+
+// cellSnapshot is what interactives change of a cell when they open it up.
+type cellSnapshot struct {
+	blockMove bool
+	blockView bool
+}
+
+// snapshot copies the map's lists and cells, but not its actors.
+func (m *Map) snapshot() *mapSnapshot {
+	snap := &mapSnapshot{
+		m:        m,
+		actors:   append([]Actor(nil), m.actors...),
+		enemies:  append([]*Enemy(nil), m.enemies...),
+		bullets:  make([]bulletSnapshot, len(m.bullets)),
+		cleared:  m.cleared,
+		currentZ: m.currentZ,
+		vfx:      m.vfx,
+	}
+	for i, b := range m.bullets {
+		snap.bullets[i] = b.snapshot()
+	}
+	snap.particles = make([]Particle, len(m.particles))
+	for i, p := range m.particles {
+		snap.particles[i] = *p
+	}
+	for _, layer := range m.Cells {
+		for _, row := range layer {
+			for _, cell := range row {
+				snap.cells = append(snap.cells, cellSnapshot{
+					blockMove: cell.blockMove,
+					blockView: cell.blockView,
+				})
+			}
+		}
+	}
+	return snap
+}
+
+func (snap *mapSnapshot) restore() {
+	m := snap.m
+	m.actors = snap.actors
+	m.enemies = snap.enemies
+	m.bullets = make([]*Bullet, len(snap.bullets))
+	for i, b := range snap.bullets {
+		m.bullets[i] = b.restore()
+	}
+	m.particles = make([]*Particle, len(snap.particles))
+	for i := range snap.particles {
+		m.particles[i] = &snap.particles[i]
+	}
+	i := 0
+	for z := range m.Cells {
+		for y := range m.Cells[z] {
+			for x := range m.Cells[z][y] {
+				m.Cells[z][y][x].blockMove = snap.cells[i].blockMove
+				m.Cells[z][y][x].blockView = snap.cells[i].blockView
+				i++
+			}
+		}
+	}
+	m.cleared = snap.cleared
+	m.currentZ = snap.currentZ
+	m.vfx = snap.vfx
+}
+
+// actorSnapshot puts an actor back the way it was when it was taken.
+type actorSnapshot interface {
+	restore()
+}
+
+// pcSnapshot keeps a whole copy of the PC.
+type pcSnapshot struct {
+	pc    *PC
+	state PC
+}
+
+func (p *PC) snapshot() actorSnapshot {
+	return pcSnapshot{pc: p, state: *p}
+}
+
+func (snap pcSnapshot) restore() {
+	*snap.pc = snap.state
+}
+
+type companionSnapshot struct {
+	companion *Companion
+	state     Companion
+}
+
+func (p *Companion) snapshot() actorSnapshot {
+	return companionSnapshot{companion: p, state: *p}
+}
+
+func (snap companionSnapshot) restore() {
+	*snap.companion = snap.state
+}
+
+type interactiveSnapshot struct {
+	interactive      *Interactive
+	active           bool
+	hp               int
+	activationIdx    int
+	activateCooldown int
+}
+
+func (i *Interactive) snapshot() actorSnapshot {
+	return interactiveSnapshot{
+		interactive:      i,
+		active:           i.active,
+		hp:               i.hp,
+		activationIdx:    i.activationIdx,
+		activateCooldown: i.activateCooldown,
+	}
+}
+
+func (snap interactiveSnapshot) restore() {
+	snap.interactive.active = snap.active
+	snap.interactive.hp = snap.hp
+	snap.interactive.activationIdx = snap.activationIdx
+	snap.interactive.activateCooldown = snap.activateCooldown
+}
+
+type snaggableSnapshot struct {
+	snaggable    *Snaggable
+	x, y         float64
+	destroyed    bool
+	nextParticle int
+}
+
+func (s *Snaggable) snapshot() actorSnapshot {
+	return snaggableSnapshot{
+		snaggable:    s,
+		x:            s.shape.X,
+		y:            s.shape.Y,
+		destroyed:    s.destroyed,
+		nextParticle: s.nextParticle,
+	}
+}
+
+func (snap snaggableSnapshot) restore() {
+	snap.snaggable.SetXY(snap.x, snap.y)
+	snap.snaggable.destroyed = snap.destroyed
+	snap.snaggable.nextParticle = snap.nextParticle
+}
+
+// spawnerSnapshot keeps the progress of each of a spawner's groups.
+type spawnerSnapshot struct {
+	spawner *Spawner
+	x, y    float64
+	groups  []bulletGroupSnapshot
+}
+
+type bulletGroupSnapshot struct {
+	x, y          float64
+	lastSpawnedAt int
+	loopCount     int
+}
+
+func (s *Spawner) snapshot() actorSnapshot {
+	snap := spawnerSnapshot{
+		spawner: s,
+		x:       s.shape.X,
+		y:       s.shape.Y,
+		groups:  make([]bulletGroupSnapshot, len(s.bulletGroups)),
+	}
+	for i, bg := range s.bulletGroups {
+		snap.groups[i] = bulletGroupSnapshot{
+			x:             bg.X,
+			y:             bg.Y,
+			lastSpawnedAt: bg.lastSpawnedAt,
+			loopCount:     bg.loopCount,
+		}
+	}
+	return snap
+}
+
+func (snap spawnerSnapshot) restore() {
+	snap.spawner.shape.X = snap.x
+	snap.spawner.shape.Y = snap.y
+	for i, bg := range snap.spawner.bulletGroups {
+		bg.SetXY(snap.groups[i].x, snap.groups[i].y)
+		bg.lastSpawnedAt = snap.groups[i].lastSpawnedAt
+		bg.loopCount = snap.groups[i].loopCount
+	}
+}
+
+type enemySnapshot struct {
+	enemy             *Enemy
+	x, y              float64
+	target            Actor
+	state             EnemyState
+	wanderDir         float64
+	rethinkTime       int
+	health            int
+	friendly          bool
+	hasDied           bool
+	invulnerableTicks int
+	hitAccumulator    int
+	ticksUntilSfx     int
+	spawner           actorSnapshot
+}
+
+func (e *Enemy) snapshot() actorSnapshot {
+	snap := enemySnapshot{
+		enemy:             e,
+		x:                 e.shape.X,
+		y:                 e.shape.Y,
+		target:            e.target,
+		state:             e.state,
+		wanderDir:         e.wanderDir,
+		rethinkTime:       e.rethinkTime,
+		health:            e.health,
+		friendly:          e.friendly,
+		hasDied:           e.hasDied,
+		invulnerableTicks: e.invulnerableTicks,
+		hitAccumulator:    e.hitAccumulator,
+		ticksUntilSfx:     e.ticksUntilSfx,
+	}
+	if e.spawner != nil {
+		snap.spawner = e.spawner.snapshot()
+	}
+	return snap
+}
+
+func (snap enemySnapshot) restore() {
+	e := snap.enemy
+	e.SetXY(snap.x, snap.y)
+	e.target = snap.target
+	e.state = snap.state
+	e.wanderDir = snap.wanderDir
+	e.rethinkTime = snap.rethinkTime
+	e.health = snap.health
+	e.friendly = snap.friendly
+	e.hasDied = snap.hasDied
+	e.invulnerableTicks = snap.invulnerableTicks
+	e.hitAccumulator = snap.hitAccumulator
+	e.ticksUntilSfx = snap.ticksUntilSfx
+	if snap.spawner != nil {
+		snap.spawner.restore()
+	}
+}
+
+// bulletSnapshot keeps a bullet along with what it was.
+type bulletSnapshot struct {
+	bullet *Bullet
+	state  Bullet
+}
+
+func (b *Bullet) snapshot() bulletSnapshot {
+	snap := bulletSnapshot{bullet: b, state: *b}
+	snap.state.timeLine = append([]*Bullet(nil), b.timeLine...)
+	return snap
+}
+
+// restore puts the bullet back the way it was and returns it.
+func (snap bulletSnapshot) restore() *Bullet {
+	*snap.bullet = snap.state
+	return snap.bullet
+}
@@ -1,6 +1,8 @@
 package game
 
 import (
+	"math/rand"
+
 	"github.com/ketMix/retromancer/resources"
 
 	"github.com/ketMix/retromancer/states"
@@ -12,7 +14,7 @@ type Spawner struct {
 	bulletGroups []*BulletGroup
 }
 
-func CreateSpawner(ctx states.Context, bulletGroupDefs []*resources.BulletGroup) *Spawner {
+func CreateSpawner(ctx states.Context, rng *rand.Rand, bulletGroupDefs []*resources.BulletGroup) *Spawner {
 	bulletGroups := make([]*BulletGroup, 0)
 
 	// If we have bullet groups defined for the spawner, create them.
@@ -22,7 +24,7 @@ func CreateSpawner(ctx states.Context, bulletGroupDefs []*resources.BulletGroup)
 			if bg.Alias != nil {
 				bulletAlias = ctx.R.GetAs("bullets", *bg.Alias, (*resources.BulletGroup)(nil)).(*resources.BulletGroup)
 			}
-			bulletGroups = append(bulletGroups, CreateBulletGroupFromDef(bg, bulletAlias))
+			bulletGroups = append(bulletGroups, CreateBulletGroupFromDef(bg, bulletAlias, rng))
 		}
 	}
 	return &Spawner{
@@ -2,6 +2,7 @@ package game
 
 import (
 	"encoding/binary"
+	"math"
 
 	"github.com/ketMix/retromancer/net"
 )
@@ -10,7 +11,8 @@ import (
 type Thought interface {
 	Ident() uint8
 	ToBytes() []byte
-	FromBytes(b []byte) (net.Message, int)
+	FromBytes(b []byte) (net.Message, int, error)
+	thought() // Sets thoughts apart from every other message, so a Thoughts cannot carry anything else.
 }
 
 type Thoughts struct {
@@ -23,23 +25,37 @@ func (t Thoughts) Ident() uint8 {
 
 func (t Thoughts) ToBytes() (b []byte) {
 	b = append(b, t.Ident())
-	b = binary.LittleEndian.AppendUint64(b, uint64(len(t.Thoughts)))
+	b = binary.AppendUvarint(b, uint64(len(t.Thoughts)))
 	for _, thought := range t.Thoughts {
 		b = append(b, thought.ToBytes()...)
 	}
 	return
 }
 
-func (t Thoughts) FromBytes(b []byte) (net.Message, int) {
-	offset := 1
-	t.Thoughts = make([]Thought, binary.LittleEndian.Uint64(b[offset:]))
-	offset += 8
+func (t Thoughts) FromBytes(b []byte) (net.Message, int, error) {
+	count, n := binary.Uvarint(b[1:])
+	if n <= 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset := 1 + n
+	// Every thought takes at least a byte, so anything claiming more than that is lying.
+	if count > uint64(len(b)-offset) {
+		return nil, 0, net.ErrBadCount
+	}
+	t.Thoughts = make([]Thought, count)
 	for i := 0; i < len(t.Thoughts); i++ {
-		thought, n := net.MessageFromBytes(b[offset:])
-		t.Thoughts[i] = thought.(Thought)
+		msg, n, err := net.MessageFromBytes(b[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		thought, ok := msg.(Thought)
+		if !ok {
+			return nil, 0, net.ErrUnexpectedMessage
+		}
+		t.Thoughts[i] = thought
 		offset += n
 	}
-	return t, offset
+	return t, offset, nil
 }
 
 type ResetThought struct{}
@@ -53,10 +69,12 @@ func (t ResetThought) ToBytes() (b []byte) {
 	return
 }
 
-func (t ResetThought) FromBytes(b []byte) (net.Message, int) {
-	return t, 1
+func (t ResetThought) FromBytes(b []byte) (net.Message, int, error) {
+	return t, 1, nil
 }
 
+func (t ResetThought) thought() {}
+
 type QuitThought struct{}
 
 func (t QuitThought) Ident() uint8 {
@@ -68,18 +86,25 @@ func (t QuitThought) ToBytes() (b []byte) {
 	return
 }
 
-func (t QuitThought) FromBytes(b []byte) (net.Message, int) {
-	return t, 1
+func (t QuitThought) FromBytes(b []byte) (net.Message, int, error) {
+	return t, 1, nil
 }
 
+func (t QuitThought) thought() {}
+
 func init() {
 	net.RegisterMessage(Thoughts{})
 	net.RegisterMessage(ResetThought{})
 	net.RegisterMessage(QuitThought{})
 	net.RegisterMessage(TickState{})
+	net.RegisterMessage(TickRequest{})
 }
 
+// TickState is a player's thoughts and impulses for the given tick.
 type TickState struct {
+	Tick     uint32
+	Slot     uint8
+	Repeat   bool // Set if the impulses are unchanged from the slot's previous tick, in which case they are left out.
 	Thoughts Thoughts
 	Impulses ImpulseSet
 }
@@ -90,18 +115,75 @@ func (t TickState) Ident() uint8 {
 
 func (t TickState) ToBytes() (b []byte) {
 	b = append(b, t.Ident())
+	b = binary.AppendUvarint(b, uint64(t.Tick))
+	b = append(b, t.Slot)
+	if t.Repeat {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
 	b = append(b, t.Thoughts.ToBytes()...)
-	b = append(b, t.Impulses.ToBytes()...)
+	if !t.Repeat {
+		b = append(b, t.Impulses.ToBytes()...)
+	}
 	return
 }
 
-func (t TickState) FromBytes(b []byte) (net.Message, int) {
-	offset := 1
-	thoughts, n := net.MessageFromBytes(b[offset:])
-	t.Thoughts = thoughts.(Thoughts)
+func (t TickState) FromBytes(b []byte) (net.Message, int, error) {
+	tick, n := binary.Uvarint(b[1:])
+	if n <= 0 || tick > math.MaxUint32 || len(b) < 1+n+2 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset := 1 + n
+	t.Tick = uint32(tick)
+	t.Slot = b[offset]
+	t.Repeat = b[offset+1] != 0
+	offset += 2
+	msg, n, err := net.MessageFromBytes(b[offset:])
+	if err != nil {
+		return nil, 0, err
+	}
+	thoughts, ok := msg.(Thoughts)
+	if !ok {
+		return nil, 0, net.ErrUnexpectedMessage
+	}
+	t.Thoughts = thoughts
 	offset += n
-	impulses, n := net.MessageFromBytes(b[offset:])
-	t.Impulses = impulses.(ImpulseSet)
+	if t.Repeat {
+		return t, offset, nil
+	}
+	msg, n, err = net.MessageFromBytes(b[offset:])
+	if err != nil {
+		return nil, 0, err
+	}
+	impulses, ok := msg.(ImpulseSet)
+	if !ok {
+		return nil, 0, net.ErrUnexpectedMessage
+	}
+	t.Impulses = impulses
 	offset += n
-	return t, offset
+	return t, offset, nil
+}
+
+// TickRequest asks a peer to resend every TickState it sent after the given tick.
+type TickRequest struct {
+	After uint32
+}
+
+func (t TickRequest) Ident() uint8 {
+	return 24
+}
+
+func (t TickRequest) ToBytes() (b []byte) {
+	b = append(b, t.Ident())
+	b = binary.LittleEndian.AppendUint32(b, t.After)
+	return
+}
+
+func (t TickRequest) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 5 {
+		return nil, 0, net.ErrShortMessage
+	}
+	t.After = binary.LittleEndian.Uint32(b[1:])
+	return t, 5, nil
 }
@@ -7,11 +7,8 @@ import (
 	"reflect"
 
 	"github.com/ketMix/retromancer/net"
-	"github.com/ketMix/retromancer/resources"
 
 	"github.com/ketMix/retromancer/states"
-
-	"github.com/hajimehoshi/ebiten/v2"
 )
 
 type World struct {
@@ -27,15 +24,40 @@ type World struct {
 	hints       Hints
 	activeMap   *Map
 	states      []WorldState
-	Net         net.ServerClient
+	Net         *net.ServerClient
 	Seed        int64
+	rng         simSource  // Simulation random numbers, drawn through simRNG. Being part of the world, it is checksummed, snapshotted, and sent to newcomers along with everything else.
+	simRNG      *rand.Rand // Draws from rng. Anything that can change the outcome of a tick must use this, and only during the tick.
 	savedNPCs   map[string]bool
 	Difficulty  *states.Difficulty
+	tickHistory []TickState // Recently sent and received TickStates, oldest first.
+	// Desync detection.
+	checksums       map[int]localChecksum
+	remoteChecksums []remoteChecksum
+	missedChecksums int                // Peers' checksums that arrived too late to compare.
+	desynced        map[*net.Peer]int  // Tick we first desynced with each peer on.
+	desyncDumps     map[*net.Peer]bool // Peers whose state dump we have written.
+	// Input delay and rollback.
+	InputDelay int            // Ticks local impulses are delayed by in networked play. Must be the same for everyone, so the host decides it.
+	snapshot   *worldSnapshot // The last tick we had everyone's impulses for, kept while we guess ahead of it.
+	chat       Chat
+	// Host migration.
+	newHost     uint32          // ID of the host we moved to, once ours has left.
+	leftReports map[uint32]bool // Who has told us, as the new host, how far they got with the departed players.
+	// Drop-in joins.
+	Join         *Join         // Set to start from a snapshot of a game underway rather than from the beginning.
+	joinRequests []joinRequest // Newcomers waiting for the host to let them in.
+	joins        []pendingJoin // Players joining on a coming tick, and those that joined recently enough to be rolled back past.
+	// Replays.
+	Replay   *Replay // Set to play back a recorded game rather than take anyone's input.
+	recorder *replayRecorder
 }
 
-var (
-	rng *rand.Rand
-)
+// fxRNG draws for cosmetics, such as particles. It is never kept in step between peers.
+var fxRNG *rand.Rand
+
+// TickHistory is how many ticks worth of TickStates are kept to replay to a peer that reconnects.
+var TickHistory = 120
 
 func (s *World) PushState(state WorldState, ctx states.Context) {
 	// Mmmmm
@@ -62,36 +84,49 @@ func (s *World) Init(ctx states.Context) error {
 	// Disable the global cursor.
 	ctx.Cursor.Disable()
 
+	// Local games have no connection.
+	if s.Net == nil {
+		s.Net = &net.ServerClient{}
+	}
+
 	// Init the overlay.
 	if err := s.overlay.Init(ctx); err != nil {
 		return err
 	}
 
-	// Initialize the the game package specific RNG with the passed in sneed.
-	rng = rand.New(rand.NewSource(s.Seed))
+	s.chat.Init(ctx, 320, 340, 300)
+
+	// Initialize the the game package specific RNGs with the passed in sneed.
+	s.rng.Seed(s.Seed)
+	s.simRNG = rand.New(&s.rng)
+	fxRNG = rand.New(rand.NewSource(s.Seed))
 
 	s.savedNPCs = make(map[string]bool)
 
+	// Drop into the game underway that the host sent us, or play back a recorded one.
+	if s.Join != nil {
+		s.startJoin()
+	} else if s.Replay != nil {
+		s.startReplay()
+	}
+	// Maps are loaded at the game's difficulty, as they are during play.
+	if s.Difficulty != nil {
+		ctx.Difficulty = *s.Difficulty
+	}
+
 	// Create actors for our players.
 	for i, p := range s.Players {
-		if (!s.Net.Running && i == 0) || (s.Net.Hosting && i == 0) || (!s.Net.Hosting && s.Net.Running && i == 1) {
-			pc := s.NewPC(ctx)
-
-			pc.Hat = resources.NewSprite(ctx.R.GetAs("images", p.Hat(), (*ebiten.Image)(nil)).(*ebiten.Image))
-
-			// If the starting map is not start, then set the player as resurrected.
-			if s.StartingMap != "start" {
-				pc.resurrected = true
-			}
-
-			p.SetActor(pc)
-		} else {
-			c := s.NewCompanion(ctx)
-
-			c.Hat = resources.NewSprite(ctx.R.GetAs("images", p.Hat(), (*ebiten.Image)(nil)).(*ebiten.Image))
-
-			p.SetActor(c)
+		// Nobody has impulses for the ticks before the first delayed ones arrive.
+		if remote, ok := p.(*RemotePlayer); ok {
+			remote.lastTick = s.inputDelay()
+		} else if local, ok := p.(*LocalPlayer); ok {
+			local.sentImpulses = ImpulseSet{}
+		}
+		isPC := IsPCSlot(i)
+		if s.Join != nil {
+			isPC = !s.Join.Snapshot.Slots[i].Companion
 		}
+		s.newPlayerActor(ctx, p, isPC)
 	}
 
 	// Init the hints.
@@ -142,18 +177,37 @@ func (s *World) Init(ctx states.Context) error {
 
 	// Set our starting state.
 	if len(s.states) == 0 {
-		s.PushState(&WorldStateBegin{}, ctx)
+		if s.Join != nil {
+			s.PushState(&WorldStateLive{}, ctx)
+		} else {
+			s.PushState(&WorldStateBegin{}, ctx)
+		}
 	}
 
 	// Travel to the starting map.
 	s.TravelToMap(ctx, s.StartingMap)
 
+	if s.Join != nil {
+		if err := s.finishJoin(ctx); err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
+
+	// Only games played from the beginning can be replayed.
+	if RecordReplay != "" && s.Join == nil && s.Replay == nil {
+		if err := s.startRecording(string(ctx.Difficulty)); err != nil {
+			fmt.Println("not recording replay:", err)
+		}
+	}
+
 	return nil
 }
 
 func (s *World) Finalize(ctx states.Context) error {
 	// Renable the global cursor.
 	ctx.Cursor.Enable()
+	s.stopRecording()
 	return nil
 }
 
@@ -168,118 +222,275 @@ func (s *World) Update(ctx states.Context) error {
 	s.overlay.Update(ctx)
 
 	if s.Net.Running {
-		select {
-		case ev := <-s.Net.EventChan:
-			switch e := ev.(type) {
-			case net.EventMessage:
-				player := s.PlayerFromPeer(e.Peer)
-				if player != nil {
+		// Handle every pending event, as a single packet may carry several messages.
+	events:
+		for {
+			select {
+			case ev := <-s.Net.EventChan:
+				switch e := ev.(type) {
+				case net.EventMessage:
 					switch msg := e.Message.(type) {
-					case Thoughts:
-						player.thoughts = msg
 					case TickState:
-						if s.tick == player.lastTick+1 {
-							player.QueueImpulses(msg.Impulses)
-							player.ClearImpulses()
-							player.lastTick++
+						s.HandleTickState(e.Peer, msg)
+					case TickRequest:
+						s.ReplayTicks(e.Peer, int(msg.After))
+					case WorldChecksum:
+						s.HandleWorldChecksum(e.Peer, msg)
+					case DesyncState:
+						s.HandleDesyncState(e.Peer, msg)
+					case ChatMessage:
+						s.HandleChat(ctx, e.Peer, msg)
+					case PlayerLeft:
+						s.HandlePlayerLeft(e.Peer, msg)
+					case JoinRequest:
+						s.HandleJoinRequest(e.Peer, msg)
+					case PlayerJoined:
+						s.HandlePlayerJoined(e.Peer, msg)
+					}
+				case net.EventHostMigrated:
+					s.HandleHostMigrated(e)
+				case net.EventConnect:
+					s.HandleJoinConnect(e.Peer)
+					s.HandleMigrationConnect(e.Peer)
+				case net.EventPunchFailed, net.EventRelayError:
+					s.HandleMigrationFailed()
+				case net.EventReconnect:
+					after := -1
+					for _, player := range s.PlayersFromPeer(e.OldPeer) {
+						player.peer = e.Peer
+						player.timedOut = false
+						player.reconnecting = false
+						if after == -1 || player.lastTick < after {
+							after = player.lastTick
 						}
 					}
+					if after >= 0 {
+						e.Peer.Send(TickRequest{After: uint32(after)})
+					}
+				case net.EventTimeout:
+					for _, player := range s.PlayersFromPeer(e.Peer) {
+						player.timedOut = true
+						player.reconnecting = false
+					}
+				case net.EventResumed:
+					for _, player := range s.PlayersFromPeer(e.Peer) {
+						player.timedOut = false
+						player.reconnecting = false
+					}
+				default:
+					fmt.Println("uhoh", e)
 				}
 			default:
-				fmt.Println("uhoh", e)
+				break events
 			}
-		default:
 		}
-		// Send our local thoughts?
-		if local, ok := s.Players[0].(*LocalPlayer); ok {
-			if local.hasNewThoughts {
-				local.hasNewThoughts = false
-				for _, p := range s.Players {
-					if remote, ok := p.(*RemotePlayer); ok {
-						remote.peer.Send(local.Thoughts())
-					}
-				}
-			}
+		// Hold everything while a player's connection is lost.
+		if s.updateConnectionPrompt(ctx) {
+			return nil
 		}
 	}
 
+	// Take back any ticks we predicted wrong now that the real impulses are in.
+	s.rollback(ctx)
+
+	chatting := s.updateChat(ctx)
+	s.updateNetStats(chatting)
+
 	s.ebitenTicks++
-	readyCount := 0
 	for _, player := range s.Players {
-		player.Update()
-		if player.Ready(s.tick + 1) {
-			readyCount++
+		// Keyboard players leave the keys alone while they are typing.
+		if local, ok := player.(*LocalPlayer); ok && chatting && local.GamepadID < 0 {
+			local.ClearImpulses()
+			continue
 		}
+		player.Update()
 	}
 	if s.ebitenTicks >= 2 { // Basically tick every 3 ebiten ticks.
-		if readyCount == len(s.Players) {
-			//fmt.Println("now ticking", s.tick)
-			// Process the players' current tick think -- this also sends impulses to their respective actors.
-			for _, player := range s.Players {
-				player.Tick()
-
-				if pc, ok := player.Actor().(*PC); ok {
-					hoveringInteractable := false
-					for _, a := range s.activeMap.interactives {
-						if !a.Reverseable() {
-							continue
-						}
-						if a.shape.Collides(&CircleShape{
-							X:      pc.Hand.Shape.X,
-							Y:      pc.Hand.Shape.Y,
-							Radius: 20,
-						}) {
-							hoveringInteractable = true
-							break
-						}
-					}
-					// This feels bad, but show the hover sprite over the player if they haven't resurrected yet.
-					if !pc.resurrected {
-						if pc.shape.Collides(&CircleShape{
-							X:      pc.Hand.Shape.X,
-							Y:      pc.Hand.Shape.Y,
-							Radius: 20,
-						}) {
-							hoveringInteractable = true
-						}
-					}
-					pc.Hand.HoverSprite.Hidden = !hoveringInteractable
-				}
+		if s.canTick(s.tick + 1) {
+			// Keep a snapshot of the last tick everyone agrees on if we are about to guess.
+			if s.snapshot == nil && s.confirmedTick() < s.tick+1 {
+				s.snapshot = s.takeSnapshot()
 			}
-
-			// Process the world!!!
-			s.CurrentState().Tick(s, ctx)
-
-			// Queue up the local player's impulses for the next tick!
-			for _, player := range s.Players {
-				if _, ok := player.(*LocalPlayer); ok {
-					player.QueueImpulses(player.Impulses())
-					for _, p := range s.Players {
-						if remote, ok := p.(*RemotePlayer); ok {
-							remote.peer.Send(TickState{
-								Impulses: player.Impulses(),
-							})
+			s.step(ctx)
+
+			// Queue up the local players' impulses and send them to our peers.
+			peers := s.TickPeers()
+			applyTick := s.tick + s.inputDelay()
+			for i, player := range s.Players {
+				if local, ok := player.(*LocalPlayer); ok {
+					impulses := player.Impulses().Quantized()
+					player.QueueInput(applyTick, impulses, local.thoughts)
+					if s.Net.Running {
+						state := TickState{
+							Tick:     uint32(applyTick),
+							Slot:     uint8(i),
+							Repeat:   impulses.Equal(local.sentImpulses),
+							Thoughts: local.thoughts,
+							Impulses: impulses,
 						}
+						local.sentImpulses = impulses
+						s.recordTick(state)
+						for _, peer := range peers {
+							peer.Queue(state)
+						}
+						local.hasNewThoughts = false
 					}
 					player.ClearImpulses()
-					// TODO: Send network message to peers with our impulses!
 				}
 			}
-
-			s.HandleTrash()
-			s.tick++
+			for _, peer := range peers {
+				peer.Flush()
+			}
 		}
 		s.ebitenTicks = 0
 	}
 
+	if s.Net.Running {
+		s.updateJoins()
+	}
+
 	return nil
 }
 
 func (s *World) Draw(ctx states.DrawContext) {
 	s.CurrentState().Draw(s, ctx)
+	s.drawChat(ctx)
+	s.drawNetStats(ctx)
+	s.drawConnectionPrompt(ctx)
 	s.overlay.Draw(ctx)
 }
 
+// step processes the next tick.
+func (s *World) step(ctx states.Context) {
+	tick := s.tick + 1
+	s.addJoiningPlayers(ctx, tick)
+
+	// Process the players' current tick think -- this also sends impulses to their respective actors.
+	for _, player := range s.Players {
+		player.Tick(tick)
+
+		if pc, ok := player.Actor().(*PC); ok {
+			hoveringInteractable := false
+			for _, a := range s.activeMap.interactives {
+				if !a.Reverseable() {
+					continue
+				}
+				if a.shape.Collides(&CircleShape{
+					X:      pc.Hand.Shape.X,
+					Y:      pc.Hand.Shape.Y,
+					Radius: 20,
+				}) {
+					hoveringInteractable = true
+					break
+				}
+			}
+			// This feels bad, but show the hover sprite over the player if they haven't resurrected yet.
+			if !pc.resurrected {
+				if pc.shape.Collides(&CircleShape{
+					X:      pc.Hand.Shape.X,
+					Y:      pc.Hand.Shape.Y,
+					Radius: 20,
+				}) {
+					hoveringInteractable = true
+				}
+			}
+			pc.Hand.HoverSprite.Hidden = !hoveringInteractable
+		}
+	}
+	s.recordReplay(tick)
+
+	// Process the world!!!
+	s.CurrentState().Tick(s, ctx)
+
+	s.HandleTrash()
+	s.tick++
+
+	// Let our peers check we ended up with the same world.
+	if s.Net.Running && s.tick%ChecksumInterval == 0 && s.tick <= s.confirmedTick() {
+		checksum := s.recordChecksum(s.tick)
+		for _, peer := range s.TickPeers() {
+			peer.Queue(checksum)
+		}
+		s.compareChecksums()
+	}
+}
+
+// HandleTickState accepts a TickState for the remote player in its slot.
+func (s *World) HandleTickState(peer *net.Peer, msg TickState) {
+	// A newcomer's first impulses may arrive before the tick they join on.
+	player, ok := s.playerInSlot(int(msg.Slot)).(*RemotePlayer)
+	if !ok || (player.peer != peer && !(player.departed && !player.left)) {
+		return
+	}
+	// Ticks we already have may be resent after a reconnect.
+	if int(msg.Tick) <= player.lastTick {
+		return
+	}
+	// Hold on to ticks that arrive early.
+	if int(msg.Tick) > player.lastTick+1 {
+		if int(msg.Tick) <= player.lastTick+inputsKept {
+			player.early[int(msg.Tick)] = msg
+		}
+		return
+	}
+	s.acceptTickState(peer, player, msg)
+	for {
+		next, ok := player.early[player.lastTick+1]
+		if !ok {
+			break
+		}
+		delete(player.early, player.lastTick+1)
+		s.acceptTickState(peer, player, next)
+	}
+}
+
+// acceptTickState queues up the impulses of the player's next tick.
+func (s *World) acceptTickState(peer *net.Peer, player *RemotePlayer, msg TickState) {
+	// Ticks are accepted in order, so the previous one is always at hand to repeat.
+	if msg.Repeat {
+		msg.Impulses = player.queued[player.lastTick].impulses
+	}
+	player.QueueInput(int(msg.Tick), msg.Impulses, msg.Thoughts)
+	player.lastTick++
+
+	// Everyone keeps what they receive, as anyone may have to pass it on should the host leave.
+	s.recordTick(msg)
+	if s.Net.Hosting {
+		for _, p := range s.TickPeers() {
+			if p != peer {
+				p.Send(msg)
+			}
+		}
+	}
+}
+
+// recordTick keeps a TickState around in case it needs to be replayed.
+func (s *World) recordTick(state TickState) {
+	s.tickHistory = append(s.tickHistory, state)
+	for len(s.tickHistory) > 0 && int(s.tickHistory[0].Tick)+TickHistory <= int(state.Tick) {
+		s.tickHistory = s.tickHistory[1:]
+	}
+}
+
+// ReplayTicks resends every TickState we have sent after the given tick to a peer.
+func (s *World) ReplayTicks(peer *net.Peer, after int) {
+	if len(s.tickHistory) > 0 && int(s.tickHistory[0].Tick) > after+1 {
+		fmt.Println("tick history no longer reaches back to", after+1)
+	}
+	// The peer may not have the tick each player's first state repeats, so those are sent in full.
+	sent := make(map[uint8]bool)
+	for _, state := range s.tickHistory {
+		if int(state.Tick) > after {
+			if !sent[state.Slot] {
+				state.Repeat = false
+				sent[state.Slot] = true
+			}
+			peer.Queue(state)
+		}
+	}
+	peer.Flush()
+}
+
 func (s *World) ArePlayersDead() bool {
 	for _, p := range s.Players {
 		if a, ok := p.Actor().(*PC); ok {
@@ -293,6 +504,10 @@ func (s *World) ArePlayersDead() bool {
 
 func (s *World) DoPlayersShareThought(thought Thought) bool {
 	for _, p := range s.Players {
+		// Players that have left have no say.
+		if remote, ok := p.(*RemotePlayer); ok && remote.left {
+			continue
+		}
 		match := false
 		for _, t := range p.Thoughts().Thoughts {
 			// More reflection, woo.
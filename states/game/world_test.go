@@ -0,0 +1,153 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ketMix/retromancer/net"
+	"github.com/ketMix/retromancer/resources"
+	"github.com/ketMix/retromancer/states"
+	"github.com/ketMix/retromancer/states/statestest"
+)
+
+// testMap is a walled room with a wandering enemy.
+func testMap() *resources.Map {
+	rows := []string{
+		"##########",
+		"#@.......#",
+		"#........#",
+		"#........#",
+		"#........#",
+		"##########",
+	}
+	var layer resources.Layer
+	for _, row := range rows {
+		var cells []resources.Cell
+		for _, r := range row {
+			cells = append(cells, resources.Cell{Type: r})
+		}
+		layer.Cells = append(layer.Cells, cells)
+	}
+	return &resources.Map{
+		Layers: []resources.Layer{layer},
+		RuneMap: map[string]resources.RuneDef{
+			"#": {Sprite: "wall", Wall: true, BlockMove: true, BlockView: true},
+			".": {Sprite: "floor", Floor: true},
+			"@": {Sprite: "floor", Floor: true},
+		},
+		Width:  len(rows[0]),
+		Height: len(rows),
+		Actors: []resources.ActorSpawn{
+			{ID: "wanderer", Type: "enemy", Sprite: "wanderer", Spawn: [3]int{6, 3, 0}},
+		},
+	}
+}
+
+func testContext() states.Context {
+	r := statestest.NewResources()
+	r.Add("maps", "test", testMap())
+	r.Add("enemies", "wanderer", &resources.Enemy{Sprite: "wanderer", Framerate: 10, Health: 10, Speed: 1, Wander: true})
+	r.Add("images", "wanderer-alive1", r.Fallback)
+	r.Add("images", "wanderer-dead1", r.Fallback)
+	return statestest.Context(r)
+}
+
+// waitForConnect reads events from the ServerClient until a peer connects.
+func waitForConnect(t *testing.T, s *net.ServerClient) *net.Peer {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-s.EventChan:
+			if e, ok := ev.(net.EventConnect); ok {
+				return e.Peer
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for a peer to connect")
+			return nil
+		}
+	}
+}
+
+func TestWorldsStayInStep(t *testing.T) {
+	const ticks = 300
+	loopback := net.NewLoopback(0)
+
+	var hostNet, joinerNet net.ServerClient
+	for _, s := range []*net.ServerClient{&hostNet, &joinerNet} {
+		s.Init()
+		s.Transport = loopback
+		s.Relay = ""
+	}
+	hostNet.Hosting = true
+
+	if err := hostNet.Open(""); err != nil {
+		t.Fatal(err)
+	}
+	defer hostNet.Close()
+	if err := joinerNet.Open(""); err != nil {
+		t.Fatal(err)
+	}
+	defer joinerNet.Close()
+	if err := joinerNet.ConnectTo(hostNet.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	toJoiner := waitForConnect(t, &hostNet)
+	toHost := waitForConnect(t, &joinerNet)
+
+	// Both sides have the host's player in the first slot and the joiner's in the second.
+	hostRemote := NewRemotePlayer(toJoiner)
+	hostRemote.SetOwner(toJoiner.ID())
+	joinerRemote := NewRemotePlayer(toHost)
+	joinerRemote.SetOwner(toHost.ID())
+	worlds := []*World{
+		{
+			StartingMap: "test",
+			Players:     []Player{NewLocalPlayer(), hostRemote},
+			Net:         &hostNet,
+			Seed:        42,
+			InputDelay:  NetInputDelay,
+		},
+		{
+			StartingMap: "test",
+			Players:     []Player{joinerRemote, NewLocalPlayer()},
+			Net:         &joinerNet,
+			Seed:        42,
+			InputDelay:  NetInputDelay,
+		},
+	}
+
+	ctx := testContext()
+	for _, w := range worlds {
+		// Skip the intro, as how long it shows for is down to the clock rather than the ticks.
+		w.states = []WorldState{&WorldStateLive{}}
+		if err := w.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for worlds[0].tick < ticks || worlds[1].tick < ticks {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out at ticks %d and %d", worlds[0].tick, worlds[1].tick)
+		}
+		for _, w := range worlds {
+			if w.tick >= ticks {
+				continue
+			}
+			if err := w.Update(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	hostState, joinerState := worlds[0].DumpState(), worlds[1].DumpState()
+	if host, joiner := worlds[0].Checksum(), worlds[1].Checksum(); host != joiner || hostState != joinerState {
+		t.Fatalf("worlds differ at tick %d: %x and %x\nhost:\n%s\njoiner:\n%s", ticks, host, joiner, hostState, joinerState)
+	}
+	// Agreeing says little unless the enemy has had the chance to wander off somewhere else.
+	if worlds[0].rng.draws == 0 {
+		t.Fatal("the simulation never drew a random number")
+	}
+}
@@ -66,7 +66,12 @@ func (w *WorldStateBegin) Tick(s *World, ctx states.Context) {
 		skip = true
 	}
 
-	if !skip && !w.vfx.Empty() {
+	if s.Replay != nil {
+		// How long the intro took to show was down to the computer the replay was recorded on.
+		if !skip && s.tick+1 != s.Replay.introEnd {
+			return
+		}
+	} else if !skip && !w.vfx.Empty() {
 		return
 	}
 
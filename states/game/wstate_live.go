@@ -107,7 +107,7 @@ func (w *WorldStateLive) Tick(s *World, ctx states.Context) {
 						if a, ok := actor.(*Interactive); ok {
 							if a.Reverseable() {
 								a.Reverse()
-								s.SpawnParticle(ctx, "reverse", action.X, action.Y, rng.Float64()*math.Pi*2, rng.Float64()*2.0, 30)
+								s.SpawnParticle(ctx, "reverse", action.X, action.Y, fxRNG.Float64()*math.Pi*2, fxRNG.Float64()*2.0, 30)
 
 								// Store saved NPCs for a later tally.
 								if a.active && a.npc {
@@ -172,7 +172,7 @@ func (w *WorldStateLive) Tick(s *World, ctx states.Context) {
 			case ActionSpawnParticle:
 				s.SpawnParticle(ctx, action.Img, action.X, action.Y, action.Angle, action.Speed, action.Life)
 			case ActionSpawnEnemy:
-				e := CreateEnemy(ctx, action.ID, action.Name)
+				e := CreateEnemy(ctx, s.simRNG, action.ID, action.Name)
 				e.SetXY(action.X, action.Y)
 				s.activeMap.actors = append(s.activeMap.actors, e)
 				s.activeMap.enemies = append(s.activeMap.enemies, e)
@@ -256,7 +256,7 @@ func (w *WorldStateLive) Tick(s *World, ctx states.Context) {
 					if bullet.Shape.Collides(actor.Shape()) {
 						x, y, _, _ := actor.Bounds()
 						for i := 0; i < 6; i++ {
-							s.SpawnParticle(ctx, "hurt", x, y, bullet.Angle-math.Pi/4+(math.Pi/2*rng.Float64()), rng.Float64()*2.0, 30)
+							s.SpawnParticle(ctx, "hurt", x, y, bullet.Angle-math.Pi/4+(math.Pi/2*fxRNG.Float64()), fxRNG.Float64()*2.0, 30)
 						}
 						bullet.Destroyed = true
 						p.Hurtie()
@@ -3,7 +3,8 @@ package menu
 import (
 	"fmt"
 	"image/color"
-	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/ketMix/retromancer/states"
@@ -21,24 +22,71 @@ type Lobby struct {
 	items           []resources.MenuItem
 	multiplayerItem *resources.ButtonItem
 	joinItem        *resources.ButtonItem
+	spectateItem    *resources.ButtonItem
 	cancelItem      *resources.ButtonItem
 	hostItem        *resources.ButtonItem
+	lobbiesItem     *resources.ButtonItem
 	backItem        *resources.TextItem
+	statusItem      *resources.TextItem
+	reconnectItem   *resources.ButtonItem
 	lobbyItem       *resources.InputItem
+	passphraseItem  *resources.InputItem
+	chat            game.Chat
 	playerEntries   []*PlayerEntry
 	overlay         game.Overlay
+	hintsItem       *resources.ButtonItem
 	shouldStart     bool
-	difficulty      states.Difficulty
+	config          LobbyConfigMessage // Settings for the game, decided by the host.
+	countdown       int                // Ticks until the game starts, if counting down.
+	inputDelay      int                // Input delay sent by the host.
 	net             rnet.ServerClient
+	lostPeer        *rnet.Peer     // Peer we have timed out waiting on.
+	benched         []*PlayerEntry // Our players, set aside while we spectate.
+	lan             rnet.LANBrowser
+	browser         rnet.ServerClient       // Asks the matchmaker for its lobbies while we look for a game.
+	lobbies         []string                // Lobbies the matchmaker last listed.
+	hostItems       []*resources.ButtonItem // Hosts found on the LAN, followed by the matchmaker's lobbies.
+	relayLobby      string                  // Lobby to join through the relay if the host cannot be reached directly.
+	lanTicks        int
+	joining         []game.Player // Our players we asked the host to drop into its game underway.
+	joinFrom        *rnet.Peer    // Host we asked to drop into its game underway, set while we wait for its snapshot.
+	join            *game.Join    // Set once the host has sent us its game underway to drop into.
 }
 
+// StartingMap is the map games started from the lobby begin on.
+var StartingMap = "start"
+
+// Seed is the seed games started from the lobby use. 0 picks one at random.
+var Seed int64
+
+// lobbyHostsListed is how many hosts and lobbies fit down the side of the lobby.
+const lobbyHostsListed = 12
+
+// LobbyCountdown is how many seconds a networked game counts down from once everyone is ready.
+var LobbyCountdown = 3
+
+var lobbyDifficulties = []states.Difficulty{states.DifficultyEasy, states.DifficultyNormal, states.DifficultyHard}
+
 func init() {
-	rnet.RegisterMessage(HatMessage{})
+	rnet.RegisterMessage(LocalPlayersMessage{})
+	rnet.RegisterMessage(RosterMessage{})
+	rnet.RegisterMessage(LobbyConfigMessage{})
 	rnet.RegisterMessage(StartMessage{})
 }
 
 func (s *Lobby) Init(ctx states.Context) error {
 	s.net.Init()
+	s.browser.Init()
+
+	s.config = LobbyConfigMessage{
+		Difficulty:  states.DifficultyNormal,
+		StartingMap: StartingMap,
+		ShowHints:   true,
+		Seed:        Seed,
+	}
+	if s.config.Seed == 0 {
+		s.config.Seed = time.Now().UnixNano()
+	}
 
 	s.overlay.Init(ctx)
 	//
@@ -58,17 +106,7 @@ func (s *Lobby) Init(ctx states.Context) error {
 		Y:    20,
 		Callback: func() bool {
 			s.clickSound.Play(1.0)
-			for _, item := range s.items {
-				if item == s.multiplayerItem {
-					s.multiplayerItem.SetHidden(true)
-					s.lobbyItem.SetHidden(false)
-					s.joinItem.SetHidden(false)
-					s.hostItem.SetHidden(false)
-					s.playerEntries = append(s.playerEntries, &PlayerEntry{})
-					s.playerEntries[len(s.playerEntries)-1].Init(s, ctx)
-					break
-				}
-			}
+			s.EnableMultiplayer(ctx)
 			return false
 		},
 	}
@@ -79,37 +117,64 @@ func (s *Lobby) Init(ctx states.Context) error {
 		Width:       150,
 		Placeholder: ctx.L.Get("Address"),
 		Callback: func() bool {
+			s.passphraseItem.Deactivate()
+			s.chat.Input.Deactivate()
 			return false
 		},
 	}
 	s.lobbyItem.SetHidden(true)
 
+	s.passphraseItem = &resources.InputItem{
+		X:           190,
+		Y:           20,
+		Width:       120,
+		Placeholder: ctx.L.Get("Passphrase"),
+		Callback: func() bool {
+			s.lobbyItem.Deactivate()
+			s.chat.Input.Deactivate()
+			return false
+		},
+	}
+	s.passphraseItem.SetHidden(true)
+
+	s.chat.Init(ctx, 120, 335, 130)
+	s.chat.Input.Callback = func() bool {
+		s.lobbyItem.Deactivate()
+		s.passphraseItem.Deactivate()
+		return false
+	}
+	s.chat.Input.SetHidden(true)
+
 	s.joinItem = &resources.ButtonItem{
 		Text: ctx.L.Get("Join"),
 		X:    450 + 50,
 		Y:    20,
 		Callback: func() bool {
 			s.clickSound.Play(1.0)
-			// TODO: Create network server:
-			//   - Check if lobby is an address or ip
-			//      - If so, begin directly hosting and wait for a client to connect.
-			//			- If not, connect to magnet's matchmaker with the lobby as the advertisement and begin waiting for a client to connect.
 			s.JoinHost(s.lobbyItem.Text)
 			return true
 		},
 	}
 	s.joinItem.SetHidden(true)
 
+	s.spectateItem = &resources.ButtonItem{
+		Text: ctx.L.Get("Spectate"),
+		X:    570,
+		Y:    20,
+		Callback: func() bool {
+			s.clickSound.Play(1.0)
+			s.SpectateHost(s.lobbyItem.Text)
+			return true
+		},
+	}
+	s.spectateItem.SetHidden(true)
+
 	s.hostItem = &resources.ButtonItem{
 		Text: ctx.L.Get("Host"),
 		X:    450,
 		Y:    20,
 		Callback: func() bool {
 			s.clickSound.Play(1.0)
-			// TODO: Create network client:
-			//   - Check if lobby is an address or ip
-			//      - If so, directly connect to it
-			//			- If not, connect to magnet's matchmaker and use the lobby as the target name. Wait for response, and if an ip:port, directly connect to it using the same socket.
 			s.StartHost(s.lobbyItem.Text)
 			return true
 		},
@@ -123,6 +188,7 @@ func (s *Lobby) Init(ctx states.Context) error {
 		Callback: func() bool {
 			s.clickSound.Play(1.0)
 			s.net.Close()
+			s.statusItem.Text = ""
 			return true
 		},
 	}
@@ -138,12 +204,58 @@ func (s *Lobby) Init(ctx states.Context) error {
 			return false
 		},
 	}
-	s.items = append(s.items, s.backItem, s.multiplayerItem, s.lobbyItem, s.joinItem, s.hostItem, s.cancelItem)
+	s.statusItem = &resources.TextItem{
+		X: 320,
+		Y: 335,
+	}
+
+	s.reconnectItem = &resources.ButtonItem{
+		Text: ctx.L.Get("Retry"),
+		X:    560,
+		Y:    335,
+		Callback: func() bool {
+			s.clickSound.Play(1.0)
+			if s.lostPeer != nil {
+				s.net.Reconnect(s.lostPeer)
+				s.statusItem.Text = ctx.L.Get("Reconnecting")
+			}
+			s.reconnectItem.SetHidden(true)
+			return true
+		},
+	}
+	s.reconnectItem.SetHidden(true)
+
+	// Shares its place with reconnectItem, as we only look for lobbies when not networking.
+	s.lobbiesItem = &resources.ButtonItem{
+		Text: ctx.L.Get("Lobbies"),
+		X:    560,
+		Y:    335,
+		Callback: func() bool {
+			s.clickSound.Play(1.0)
+			s.listLobbies(ctx)
+			return false
+		},
+	}
+	s.lobbiesItem.SetHidden(true)
+
+	s.hintsItem = &resources.ButtonItem{
+		X: 60,
+		Y: 20,
+		Callback: func() bool {
+			s.clickSound.Play(1.0)
+			s.ToggleHints()
+			return false
+		},
+	}
+
+	s.items = append(s.items, s.backItem, s.statusItem, s.reconnectItem, s.lobbiesItem, s.hintsItem, s.multiplayerItem, s.lobbyItem, s.passphraseItem, &s.chat.Input, s.joinItem, s.spectateItem, s.hostItem, s.cancelItem)
 
 	return nil
 }
 
 func (s *Lobby) Finalize(ctx states.Context) error {
+	s.lan.Close()
+	s.browser.Close()
 	return nil
 }
 
@@ -153,63 +265,62 @@ func (s *Lobby) Enter(ctx states.Context, v interface{}) error {
 
 func (s *Lobby) Update(ctx states.Context) error {
 	// Handle net stuff.
-	select {
-	case ev := <-s.net.EventChan:
-		switch e := ev.(type) {
-		case rnet.EventHosting:
-			fmt.Println("now hosting....")
-		case rnet.EventJoining:
-			fmt.Println("now joining....")
-		case rnet.EventJoined:
-			fmt.Println("now joined....")
-		case rnet.EventConnect:
-			s.AddNetPlayer(ctx, e.Peer)
-		case rnet.EventDisconnect:
-			s.RemoveNetPlayer()
-		case rnet.EventClosed:
-			s.CancelNetworking()
-		case rnet.EventMessage:
-			switch msg := e.Message.(type) {
-			case HatMessage:
-				if e := s.GetNetPlayer(e.Peer); e != nil {
-					e.hatIndex = msg.Hat
-					e.SyncHat(ctx)
-				}
-			case StartMessage:
-				if !s.net.Hosting {
-					s.shouldStart = true
-				}
+events:
+	for {
+		select {
+		case ev := <-s.net.EventChan:
+			s.HandleEvent(ctx, ev)
+			// Whatever follows the host's snapshot or word to start is for the world.
+			if s.join != nil {
+				s.startJoin(ctx)
+				return nil
+			} else if s.shouldStart {
+				s.startGame(ctx)
+				return nil
 			}
+		default:
+			break events
+		}
+	}
+browse:
+	for {
+		select {
+		case ev := <-s.browser.EventChan:
+			s.handleBrowserEvent(ctx, ev)
+		default:
+			break browse
 		}
-	default:
 	}
 
 	s.overlay.Update(ctx)
 
 	s.lobbyItem.Update()
+	s.passphraseItem.Update()
+	if line := s.chat.Update(); line != "" {
+		s.SendChat(ctx, line)
+	}
 
-	// Check for controller button hit to activate player 2.
+	// Check for controller button hits to add local players.
 	for i, gamepadID := range resources.GetFunctionalGamepads() {
 		m := resources.GetBestGamemap(gamepadID)
 		if resources.GetButton(m, gamepadID, resources.ButtonStart) {
-			if len(s.playerEntries) == 1 {
-				s.playerEntries = append(s.playerEntries, &PlayerEntry{})
-				s.playerEntries[len(s.playerEntries)-1].Init(s, ctx)
-			}
-			pl := game.NewLocalPlayer()
-			s.playerEntries[1].player = pl
-			s.playerEntries[1].controllerIndex = i
-			s.playerEntries[1].useController = true
-			s.playerEntries[1].SyncController(ctx)
-			pl.GamepadID = gamepadID
-			pl.GamepadMap = m
-			// TODO: Stop network stuff and hide host/join.
-			s.hostItem.SetHidden(true)
-			s.joinItem.SetHidden(true)
-			s.lobbyItem.SetHidden(true)
+			s.AddLocalPlayer(ctx, i, gamepadID, m)
+		}
+	}
+
+	// Keep the LAN hosts we list, or what we advertise to them, fresh.
+	s.lanTicks++
+	if s.lanTicks >= 30 {
+		s.lanTicks = 0
+		if s.net.Running && s.net.Hosting {
+			s.net.Advertise(s.Advert().ToBytes())
+		} else if s.lan.Running() {
+			s.syncHosts(ctx)
 		}
 	}
 
+	s.syncSettings(ctx)
+
 	x := -(len(s.playerEntries) - 1) * 150 / 2
 	for i, e := range s.playerEntries {
 		e.Update(ctx, float64(x+i*150))
@@ -229,42 +340,205 @@ func (s *Lobby) Update(ctx states.Context) error {
 		}
 	}
 
+	s.updateCountdown(ctx)
+
 	if s.shouldStart {
-		if s.net.Hosting {
-			for _, p := range s.net.Peers() {
-				p.Send(StartMessage{})
+		s.startGame(ctx)
+	}
+
+	return nil
+}
+
+// startGame leaves the lobby for a new game.
+func (s *Lobby) startGame(ctx states.Context) {
+	inputDelay := game.NetInputDelay
+	if s.net.Running && !s.net.Hosting {
+		inputDelay = s.inputDelay
+	}
+
+	// Our players the host never made room for are left behind.
+	var players []game.Player
+	for _, e := range s.playerEntries {
+		if e.player != nil && !e.pending {
+			if remote, ok := e.player.(*game.RemotePlayer); ok {
+				remote.SetOwner(e.id)
 			}
+			players = append(players, e.player)
 		}
+	}
+	// Once the game is underway, losing the host should not end it for everyone else.
+	s.net.MigrateHost = true
+	difficulty := s.config.Difficulty
+	ctx.StateMachine.PopState(nil)
+	ctx.StateMachine.PushState(&game.World{
+		StartingMap: s.config.StartingMap,
+		ShowHints:   s.config.ShowHints,
+		Players:     players,
+		Net:         &s.net,
+		Seed:        s.config.Seed,
+		InputDelay:  inputDelay,
+		Difficulty:  &difficulty,
+	})
+}
 
-		var seed int64
-		// Seed rand with the host's id.
-		if s.net.Running {
-			if s.net.Hosting {
-				seed = int64(s.net.ID())
-			} else {
-				seed = int64(s.net.Peers()[0].ID())
+// RequestJoin asks the host to drop our players into its game underway.
+func (s *Lobby) RequestJoin(ctx states.Context, peer *rnet.Peer) {
+	s.statusItem.Text = ctx.L.Get("Joining game in progress")
+	s.joinFrom = peer
+	s.joining = nil
+	var msg game.JoinRequest
+	for _, e := range s.playerEntries {
+		if pl, ok := e.player.(*game.LocalPlayer); ok {
+			s.joining = append(s.joining, pl)
+			msg.Hats = append(msg.Hats, pl.Hat())
+		}
+	}
+	peer.Send(msg)
+}
+
+// startJoin leaves the lobby for the game underway the host sent us.
+func (s *Lobby) startJoin(ctx states.Context) {
+	s.net.MigrateHost = true
+	ctx.StateMachine.PopState(nil)
+	ctx.StateMachine.PushState(&game.World{
+		ShowHints: s.config.ShowHints,
+		Players:   s.joining,
+		Net:       &s.net,
+		Join:      s.join,
+	})
+}
+
+// HandleEvent handles a single network event.
+func (s *Lobby) HandleEvent(ctx states.Context, ev rnet.Event) {
+	switch e := ev.(type) {
+	case rnet.EventHosting:
+		fmt.Println("now hosting....")
+	case rnet.EventJoining:
+		fmt.Println("now joining....")
+	case rnet.EventJoined:
+		fmt.Println("now joined....")
+	case rnet.EventConnect:
+		s.statusItem.Text = ""
+		if s.net.Hosting {
+			e.Peer.Send(s.config)
+			if e.Peer.Spectator() {
+				// Spectators have no players to tell us about, so just show them who is playing.
+				s.SyncRoster()
+			} else if s.PlayerCount() >= game.MaxPlayers {
+				// Wait to hear about their players before adding them, unless there is no room.
+				s.net.Reject(e.Peer, "Lobby is full")
 			}
 		} else {
-			seed = time.Now().UnixNano()
-		}
-
-		players := make([]game.Player, len(s.playerEntries))
-		for i, e := range s.playerEntries {
-			players[i] = e.player
-		}
-		// FIXME: Need to agree w/ players to start (or assume host has full control).
-		ctx.StateMachine.PopState(nil)
-		ctx.StateMachine.PushState(&game.World{
-			StartingMap: "start",
-			ShowHints:   true,
-			Players:     players,
-			Net:         s.net,
-			Seed:        seed,
-			Difficulty:  &s.difficulty,
-		})
+			s.SyncRoster()
+		}
+	case rnet.EventDisconnect:
+		if s.lostPeer == e.Peer {
+			s.lostPeer = nil
+			s.reconnectItem.SetHidden(true)
+		}
+		s.RemoveNetPlayers(ctx, e.Peer)
+	case rnet.EventClosed:
+		s.CancelNetworking(ctx)
+	case rnet.EventTimeout:
+		if s.GetNetPlayer(e.Peer) != nil {
+			s.lostPeer = e.Peer
+			s.statusItem.Text = ctx.L.Get("ConnectionLost")
+			s.reconnectItem.SetHidden(false)
+		}
+	case rnet.EventReconnect:
+		for _, entry := range s.playerEntries {
+			if pl, ok := entry.player.(*game.RemotePlayer); ok && pl.Peer() == e.OldPeer {
+				pl.SetPeer(e.Peer)
+			}
+		}
+		if s.lostPeer == e.OldPeer {
+			s.lostPeer = nil
+			s.statusItem.Text = ""
+			s.reconnectItem.SetHidden(true)
+		}
+		s.SyncRoster()
+	case rnet.EventResumed:
+		if s.lostPeer == e.Peer {
+			s.lostPeer = nil
+			s.statusItem.Text = ""
+			s.reconnectItem.SetHidden(true)
+		}
+	case rnet.EventRegistered:
+		s.statusItem.Text = fmt.Sprintf("%s %s", ctx.L.Get("Waiting in lobby"), e.Lobby)
+	case rnet.EventEndpoint:
+		s.statusItem.Text = fmt.Sprintf("%s %s", ctx.L.Get("Found"), e.Address)
+	case rnet.EventPunching:
+		s.statusItem.Text = fmt.Sprintf("%s %s", ctx.L.Get("Connecting to"), e.Address)
+	case rnet.EventPunchFailed:
+		s.statusItem.Text = fmt.Sprintf("%s %s", ctx.L.Get("Could not reach"), e.Address)
+		// A joiner can still fall back to the relay.
+		if !s.net.Hosting {
+			lobby := s.relayLobby
+			s.relayLobby = ""
+			if lobby == "" || s.net.JoinRelay(rnet.RelaySession(lobby)) != nil {
+				s.net.Close()
+			}
+		}
+	case rnet.EventRelayJoined:
+		s.statusItem.Text = ctx.L.Get("Connecting through relay")
+	case rnet.EventRelayError:
+		s.statusItem.Text = ctx.L.Get(e.Reason)
+		if !s.net.Hosting {
+			s.net.Close()
+		}
+	case rnet.EventRejected:
+		s.statusItem.Text = ctx.L.Get(e.Reason)
+		if !s.net.Hosting {
+			s.net.Close()
+		}
+	case rnet.EventMatchmakerError:
+		s.statusItem.Text = ctx.L.Get(e.Reason)
+		// Only a missing lobby is worth waiting on, or trying the relay for.
+		if e.Reason != rnet.MatchmakerReasonNotFound {
+			s.net.Close()
+		} else if !s.net.Hosting && s.relayLobby != "" {
+			if s.net.JoinRelay(rnet.RelaySession(s.relayLobby)) == nil {
+				s.relayLobby = ""
+			}
+		}
+	case rnet.EventMessage:
+		switch msg := e.Message.(type) {
+		case LocalPlayersMessage:
+			if s.net.Hosting {
+				s.SetNetPlayers(ctx, e.Peer, msg.Players)
+			}
+		case RosterMessage:
+			if !s.net.Hosting {
+				s.ApplyRoster(ctx, e.Peer, msg)
+			}
+		case game.ChatMessage:
+			s.HandleChat(ctx, e.Peer, msg)
+		case LobbyConfigMessage:
+			if !s.net.Hosting {
+				s.ApplyConfig(msg)
+			}
+		case StartMessage:
+			if !s.net.Hosting {
+				s.inputDelay = int(msg.InputDelay)
+				s.countdown = int(msg.Countdown) * ebiten.TPS()
+				if msg.Begin {
+					s.shouldStart = true
+				} else if s.countdown == 0 {
+					s.statusItem.Text = ""
+				}
+			}
+		case game.GameUnderway:
+			if !s.net.Hosting && s.joinFrom == nil {
+				s.RequestJoin(ctx, e.Peer)
+			}
+		case game.JoinSnapshot:
+			// Only the host we asked can drop us into its game.
+			if !s.net.Hosting && e.Peer == s.joinFrom && s.join == nil {
+				s.join = &game.Join{Host: e.Peer, Snapshot: msg}
+				s.joinFrom = nil
+			}
+		}
 	}
-
-	return nil
 }
 
 func (s *Lobby) Draw(ctx states.DrawContext) {
@@ -275,31 +549,71 @@ func (s *Lobby) Draw(ctx states.DrawContext) {
 	for _, m := range s.items {
 		m.Draw(ctx)
 	}
+	s.chat.Draw(ctx)
 	s.overlay.Draw(ctx)
 }
 
 // Networking stuff
 
-func (s *Lobby) CancelNetworking() {
+func (s *Lobby) CancelNetworking(ctx states.Context) {
+	for _, e := range s.playerEntries {
+		e.pending = false
+	}
+	// Bring back our players if we were spectating.
+	if s.benched != nil {
+		s.playerEntries = append(s.benched, s.playerEntries...)
+		s.benched = nil
+	}
+	s.net.Spectating = false
+	s.countdown = 0
+	s.unready()
+	s.syncOpenEntry(ctx)
+	s.lostPeer = nil
+	s.reconnectItem.SetHidden(true)
+	s.chat.Input.Deactivate()
+	s.chat.Input.SetHidden(true)
 	s.hostItem.SetHidden(false)
 	s.joinItem.SetHidden(false)
+	s.spectateItem.SetHidden(false)
 	s.cancelItem.SetHidden(true)
+	s.browseLAN()
 }
 
 func (s *Lobby) StartHost(address string) error {
 	// Use the matchmaker if the address is not an ip:port.
-	if _, err := net.ResolveUDPAddr("udp", address); err != nil {
-		s.net.UseMatchmaker = true
-	}
+	_, err := s.net.Transport.ResolveAddr(address)
+	s.net.UseMatchmaker = err != nil
 	s.net.Hosting = true
+	s.net.Passphrase = s.passphraseItem.Text
 
-	if s.net.UseMatchmaker {
+	if !s.net.Transport.Direct() {
+		// Only the relay can be reached, so everyone must join us through it.
+		s.net.UseMatchmaker = false
+		if err := s.net.Open(""); err != nil {
+			fmt.Println(err)
+			return err
+		}
+		fmt.Println("registering with relay...")
+		if err := s.net.HostRelay(rnet.RelaySession(address)); err != nil {
+			fmt.Println(err)
+			s.net.Close()
+			return err
+		}
+	} else if s.net.UseMatchmaker {
 		if err := s.net.Open(""); err != nil {
 			fmt.Println(err)
 			return err
 		}
-		// TODO: Connect to matchmaker and begin advertising.
-		fmt.Println("connecting to matchmaker...")
+		fmt.Println("registering with matchmaker...")
+		if err := s.net.RegisterLobby(address); err != nil {
+			fmt.Println(err)
+			s.net.Close()
+			return err
+		}
+		// Also wait at the relay for any joiners that cannot reach us.
+		if err := s.net.HostRelay(rnet.RelaySession(address)); err == nil {
+			fmt.Println("registering with relay...")
+		}
 	} else {
 		if err := s.net.Open(address); err != nil {
 			fmt.Println(err)
@@ -308,27 +622,55 @@ func (s *Lobby) StartHost(address string) error {
 	}
 	fmt.Println("opened....")
 
+	s.stopBrowsingLAN()
+	s.net.Advertise(s.Advert().ToBytes())
+	s.chat.Input.SetHidden(false)
 	s.hostItem.SetHidden(true)
 	s.joinItem.SetHidden(true)
+	s.spectateItem.SetHidden(true)
 	s.cancelItem.SetHidden(false)
 
 	return nil
 }
 
 func (s *Lobby) JoinHost(address string) error {
-	if _, err := net.ResolveUDPAddr("udp", address); err != nil {
-		s.net.UseMatchmaker = true
-	}
+	return s.joinHost(address, false)
+}
+
+// SpectateHost joins the given host to watch the game without any players of our own.
+func (s *Lobby) SpectateHost(address string) error {
+	return s.joinHost(address, true)
+}
+
+func (s *Lobby) joinHost(address string, spectate bool) error {
+	_, err := s.net.Transport.ResolveAddr(address)
+	s.net.UseMatchmaker = err != nil
 	s.net.Hosting = false
+	s.net.Spectating = spectate
+	s.net.Passphrase = s.passphraseItem.Text
 
 	if err := s.net.Open(""); err != nil {
 		fmt.Println(err)
 		return err
 	}
 
-	if s.net.UseMatchmaker {
-		// TODO: Connect to matchmaker and wait for response.
-		fmt.Println("connecting to matchmaker...")
+	s.relayLobby = ""
+	if !s.net.Transport.Direct() {
+		s.net.UseMatchmaker = false
+		fmt.Println("joining through relay...")
+		if err := s.net.JoinRelay(rnet.RelaySession(address)); err != nil {
+			fmt.Println(err)
+			s.net.Close()
+			return err
+		}
+	} else if s.net.UseMatchmaker {
+		s.relayLobby = address
+		fmt.Println("looking up lobby with matchmaker...")
+		if err := s.net.LookupLobby(address); err != nil {
+			fmt.Println(err)
+			s.net.Close()
+			return err
+		}
 	} else {
 		fmt.Println("connecting directly...")
 		if err := s.net.ConnectTo(address); err != nil {
@@ -339,55 +681,284 @@ func (s *Lobby) JoinHost(address string) error {
 	}
 	fmt.Println("opened...")
 
+	// Spectators only show the host's roster.
+	if spectate {
+		entries := s.playerEntries[:0]
+		for _, e := range s.playerEntries {
+			if _, ok := e.player.(*game.LocalPlayer); ok {
+				s.benched = append(s.benched, e)
+			} else if e.player != nil {
+				entries = append(entries, e)
+			}
+		}
+		s.playerEntries = entries
+	}
+
+	s.stopBrowsingLAN()
+	s.chat.Input.SetHidden(false)
 	s.hostItem.SetHidden(true)
 	s.joinItem.SetHidden(true)
+	s.spectateItem.SetHidden(true)
 	s.cancelItem.SetHidden(false)
 
 	return nil
 }
 
-func (s *Lobby) AddNetPlayer(ctx states.Context, peer *rnet.Peer) {
-	if len(s.playerEntries) == 1 {
+// EnableMultiplayer makes room for more players and shows the network controls.
+func (s *Lobby) EnableMultiplayer(ctx states.Context) {
+	if s.multiplayerItem.Hidden() {
 		return
 	}
-	pl := game.NewRemotePlayer(peer)
-	s.playerEntries[1].player = pl
-	s.playerEntries[1].hatLeft.SetHidden(true)
-	s.playerEntries[1].hatRight.SetHidden(true)
-	s.playerEntries[1].controllerLeft.SetHidden(true)
-	s.playerEntries[1].controllerRight.SetHidden(true)
-	s.playerEntries[1].controllerItem.Sprite = resources.NewSprite(ctx.R.Get("images", "network").(*ebiten.Image))
-	s.playerEntries[1].controllerItem.Sprite.Centered = true
-	s.playerEntries[1].waitingText.SetHidden(true)
-	s.playerEntries[1].startText.SetHidden(true)
-
-	// Send our hat to them.
-	peer.Send(HatMessage{
-		Hat: s.playerEntries[0].hatIndex,
-	})
+	s.multiplayerItem.SetHidden(true)
+	if !s.net.Running {
+		s.lobbyItem.SetHidden(false)
+		s.passphraseItem.SetHidden(false)
+		s.joinItem.SetHidden(false)
+		s.spectateItem.SetHidden(false)
+		s.hostItem.SetHidden(false)
+		s.browseLAN()
+	}
+	s.syncOpenEntry(ctx)
 }
 
-func (s *Lobby) RemoveNetPlayer() {
-	if len(s.playerEntries) == 1 {
+// PlayerCount returns how many entries have a player, local or remote.
+func (s *Lobby) PlayerCount() (count int) {
+	for _, e := range s.playerEntries {
+		if e.player != nil {
+			count++
+		}
+	}
+	return
+}
+
+// AddLocalPlayer adds a player using the given gamepad.
+func (s *Lobby) AddLocalPlayer(ctx states.Context, controllerIndex int, gamepadID int, gamemap string) {
+	if s.net.Running && s.net.Spectating {
+		return
+	}
+	locals := 0
+	for _, e := range s.playerEntries {
+		if pl, ok := e.player.(*game.LocalPlayer); ok {
+			if pl.GamepadID == gamepadID {
+				return
+			}
+			locals++
+		}
+	}
+
+	s.EnableMultiplayer(ctx)
+
+	var entry *PlayerEntry
+	for _, e := range s.playerEntries {
+		if e.player == nil {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
 		return
 	}
 
-	s.playerEntries[1].player = nil
-	s.playerEntries[1].hatLeft.SetHidden(false)
-	s.playerEntries[1].hatRight.SetHidden(false)
-	s.playerEntries[1].controllerLeft.SetHidden(false)
-	s.playerEntries[1].controllerRight.SetHidden(false)
-	s.playerEntries[1].waitingText.SetHidden(false)
-	s.playerEntries[1].startText.SetHidden(false)
+	pl := game.NewLocalPlayer()
+	entry.player = pl
+	entry.index = locals
+	entry.pending = s.net.Running && !s.net.Hosting
+	entry.controllerIndex = controllerIndex
+	entry.useController = true
+	entry.SyncController(ctx)
+	entry.SyncHat(ctx)
+	pl.GamepadID = gamepadID
+	pl.GamepadMap = gamemap
 
-	/*for i, e := range s.playerEntries {
-		if pl, ok := e.player.(*game.RemotePlayer); ok {
-			if pl.Peer() == peer {
-				s.playerEntries = append(s.playerEntries[:i], s.playerEntries[i+1:]...)
-				return
+	s.syncOpenEntry(ctx)
+	s.SyncRoster()
+}
+
+// syncOpenEntry keeps a single empty entry after the players.
+func (s *Lobby) syncOpenEntry(ctx states.Context) {
+	var open *PlayerEntry
+	entries := s.playerEntries[:0]
+	for _, e := range s.playerEntries {
+		if e.player != nil {
+			entries = append(entries, e)
+		} else if open == nil {
+			open = e
+		}
+	}
+	s.playerEntries = entries
+
+	if !s.multiplayerItem.Hidden() || len(s.playerEntries) >= game.MaxPlayers || s.net.Spectating {
+		return
+	}
+	if open == nil {
+		open = &PlayerEntry{}
+		open.Init(s, ctx)
+	}
+	s.playerEntries = append(s.playerEntries, open)
+}
+
+// SetNetPlayers is used by the host to add, update, or remove the players of a joiner.
+func (s *Lobby) SetNetPlayers(ctx states.Context, peer *rnet.Peer, players []LocalPlayer) {
+	existing := make(map[int]*PlayerEntry)
+	entries := s.playerEntries[:0]
+	for _, e := range s.playerEntries {
+		if pl, ok := e.player.(*game.RemotePlayer); ok && pl.Peer() == peer {
+			if e.index >= len(players) {
+				continue
+			}
+			existing[e.index] = e
+		}
+		entries = append(entries, e)
+	}
+	s.playerEntries = entries
+
+	s.EnableMultiplayer(ctx)
+
+	for i, player := range players {
+		e := existing[i]
+		if e == nil {
+			if s.PlayerCount() >= game.MaxPlayers {
+				break
+			}
+			e = &PlayerEntry{}
+			e.Init(s, ctx)
+			e.SetRemote(ctx, game.NewRemotePlayer(peer))
+			e.id = peer.ID()
+			e.index = i
+			s.playerEntries = append(s.playerEntries, e)
+		}
+		if player.Hat >= 0 && player.Hat < len(e.hats) {
+			e.hatIndex = player.Hat
+			e.SyncHat(ctx)
+		}
+		e.ready = player.Ready
+	}
+
+	s.syncOpenEntry(ctx)
+	s.SyncRoster()
+}
+
+// RemoveNetPlayers removes every player reached through the given peer.
+func (s *Lobby) RemoveNetPlayers(ctx states.Context, peer *rnet.Peer) {
+	entries := s.playerEntries[:0]
+	for _, e := range s.playerEntries {
+		if pl, ok := e.player.(*game.RemotePlayer); ok && pl.Peer() == peer {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	s.playerEntries = entries
+
+	s.syncOpenEntry(ctx)
+	if s.net.Hosting {
+		s.SyncRoster()
+	}
+}
+
+// ApplyRoster is used by a joiner to order its entries to match the host's roster.
+func (s *Lobby) ApplyRoster(ctx states.Context, peer *rnet.Peer, msg RosterMessage) {
+	var locals, remotes []*PlayerEntry
+	for _, e := range s.playerEntries {
+		switch e.player.(type) {
+		case *game.LocalPlayer:
+			e.pending = true
+			locals = append(locals, e)
+		case *game.RemotePlayer:
+			remotes = append(remotes, e)
+		}
+	}
+
+	var entries []*PlayerEntry
+	for _, slot := range msg.Slots {
+		var entry *PlayerEntry
+		if slot.Owner == s.net.ID() {
+			for _, e := range locals {
+				if e.index == int(slot.Index) {
+					entry = e
+					entry.pending = false
+					break
+				}
+			}
+			if entry == nil {
+				continue
+			}
+		} else {
+			for _, e := range remotes {
+				if e.id == slot.Owner && e.index == int(slot.Index) {
+					entry = e
+					break
+				}
+			}
+			if entry == nil {
+				entry = &PlayerEntry{}
+				entry.Init(s, ctx)
+				entry.SetRemote(ctx, game.NewRemotePlayer(peer))
+				entry.id = slot.Owner
+				entry.index = int(slot.Index)
+			}
+			if slot.Hat >= 0 && slot.Hat < len(entry.hats) {
+				entry.hatIndex = slot.Hat
+				entry.SyncHat(ctx)
+			}
+			entry.ready = slot.Ready
+		}
+		entries = append(entries, entry)
+	}
+	// Keep showing our players that the host has yet to hear about.
+	for _, e := range locals {
+		if e.pending {
+			entries = append(entries, e)
+		}
+	}
+	s.playerEntries = entries
+
+	s.EnableMultiplayer(ctx)
+	s.syncOpenEntry(ctx)
+}
+
+// Roster returns the host's view of every player.
+func (s *Lobby) Roster() (msg RosterMessage) {
+	for _, e := range s.playerEntries {
+		switch e.player.(type) {
+		case *game.LocalPlayer:
+			msg.Slots = append(msg.Slots, RosterSlot{
+				Owner: s.net.ID(),
+				Index: uint8(e.index),
+				Hat:   e.hatIndex,
+				Ready: e.ready,
+			})
+		case *game.RemotePlayer:
+			msg.Slots = append(msg.Slots, RosterSlot{
+				Owner: e.id,
+				Index: uint8(e.index),
+				Hat:   e.hatIndex,
+				Ready: e.ready,
+			})
+		}
+	}
+	return
+}
+
+// SyncRoster lets everyone know about changes to the players.
+func (s *Lobby) SyncRoster() {
+	if !s.net.Running || s.net.Spectating {
+		return
+	}
+	var msg rnet.Message
+	if s.net.Hosting {
+		msg = s.Roster()
+	} else {
+		var locals LocalPlayersMessage
+		for _, e := range s.playerEntries {
+			if _, ok := e.player.(*game.LocalPlayer); ok {
+				locals.Players = append(locals.Players, LocalPlayer{Hat: e.hatIndex, Ready: e.ready})
 			}
 		}
-	}*/
+		msg = locals
+	}
+	for _, p := range s.net.Peers() {
+		p.Send(msg)
+	}
 }
 
 func (s *Lobby) GetNetPlayer(peer *rnet.Peer) *PlayerEntry {
@@ -401,10 +972,320 @@ func (s *Lobby) GetNetPlayer(peer *rnet.Peer) *PlayerEntry {
 	return nil
 }
 
-func (s *Lobby) SendToNetPlayers(msg rnet.Message) {
+// SendChat shows a line of chat from us and sends it to our peers.
+func (s *Lobby) SendChat(ctx states.Context, text string) {
+	name := ctx.L.Get("Spectator")
+	for i, e := range s.playerEntries {
+		if _, ok := e.player.(*game.LocalPlayer); ok {
+			name = fmt.Sprintf("P%d", i+1)
+			break
+		}
+	}
+	msg := game.ChatMessage{Name: name, Text: game.ChatText(text)}
+	s.chat.Add(msg.Name, msg.Text)
+	for _, p := range s.net.Peers() {
+		p.Send(msg)
+	}
+}
+
+// HandleChat shows a line of chat from a peer, which the host passes on.
+func (s *Lobby) HandleChat(ctx states.Context, peer *rnet.Peer, msg game.ChatMessage) {
+	msg.Text = game.ChatText(msg.Text)
+	if !s.net.Hosting {
+		s.chat.Add(msg.Name, msg.Text)
+		return
+	}
+	msg.Name = ctx.L.Get("Spectator")
+	for i, e := range s.playerEntries {
+		if pl, ok := e.player.(*game.RemotePlayer); ok && pl.Peer() == peer {
+			msg.Name = fmt.Sprintf("P%d", i+1)
+			break
+		}
+	}
+	s.chat.Add(msg.Name, msg.Text)
+	for _, p := range s.net.Peers() {
+		if p != peer {
+			p.Send(msg)
+		}
+	}
+}
+
+// Advert describes our lobby to those looking for one on the LAN.
+func (s *Lobby) Advert() LobbyAdvert {
+	advert := LobbyAdvert{
+		Difficulty: string(s.config.Difficulty),
+		Players:    uint8(s.PlayerCount()),
+		MaxPlayers: game.MaxPlayers,
+	}
 	for _, e := range s.playerEntries {
-		if pl, ok := e.player.(*game.RemotePlayer); ok {
-			pl.Peer().Send(msg)
+		if _, ok := e.player.(*game.LocalPlayer); ok {
+			advert.Hat = strings.TrimPrefix(e.hats[e.hatIndex], "hat-")
+			break
+		}
+	}
+	return advert
+}
+
+// browseLAN starts listening for hosts on the LAN.
+func (s *Lobby) browseLAN() {
+	if s.net.Running || s.multiplayerItem == nil || !s.multiplayerItem.Hidden() {
+		return
+	}
+	// The matchmaker can only be reached directly.
+	s.lobbiesItem.SetHidden(!s.browser.Transport.Direct())
+	if s.lan.Running() {
+		return
+	}
+	if err := s.lan.Open(); err != nil {
+		fmt.Println("not looking for LAN games:", err)
+	}
+}
+
+// stopBrowsingLAN stops looking for hosts and removes any that were listed.
+func (s *Lobby) stopBrowsingLAN() {
+	s.lan.Close()
+	// Closing waits a moment for goodbyes that nobody is there to hear.
+	s.browser.Close()
+	s.lobbies = nil
+	s.lobbiesItem.SetHidden(true)
+	s.setHostItems(nil)
+}
+
+// listLobbies asks the matchmaker for its lobbies.
+func (s *Lobby) listLobbies(ctx states.Context) {
+	if !s.browser.Running {
+		if err := s.browser.Open(""); err != nil {
+			fmt.Println(err)
+			return
 		}
 	}
+	if err := s.browser.ListLobbies(); err != nil {
+		fmt.Println(err)
+		s.statusItem.Text = ctx.L.Get("Could not reach") + " " + s.browser.Matchmaker
+		return
+	}
+	s.statusItem.Text = ctx.L.Get("Looking for lobbies")
+}
+
+// handleBrowserEvent handles the matchmaker's answers to listLobbies.
+func (s *Lobby) handleBrowserEvent(ctx states.Context, ev rnet.Event) {
+	if s.net.Running {
+		return
+	}
+	switch e := ev.(type) {
+	case rnet.EventLobbies:
+		s.lobbies = e.Lobbies
+		sort.Strings(s.lobbies)
+		if len(s.lobbies) == 0 {
+			s.statusItem.Text = ctx.L.Get("No lobbies found")
+		} else {
+			s.statusItem.Text = ""
+		}
+		s.syncHosts(ctx)
+	case rnet.EventMatchmakerError:
+		s.statusItem.Text = ctx.L.Get(e.Reason)
+	}
+}
+
+// syncHosts lists the LAN's hosts and the matchmaker's lobbies.
+func (s *Lobby) syncHosts(ctx states.Context) {
+	var items []*resources.ButtonItem
+	add := func(text string, join func()) {
+		if len(items) >= lobbyHostsListed {
+			return
+		}
+		items = append(items, &resources.ButtonItem{
+			Text: text,
+			X:    560,
+			Y:    50 + float64(len(items))*22,
+			Callback: func() bool {
+				s.clickSound.Play(1.0)
+				join()
+				return true
+			},
+		})
+	}
+	for _, host := range s.lan.Hosts() {
+		msg, _, err := LobbyAdvert{}.FromBytes(host.Info)
+		if err != nil {
+			continue
+		}
+		advert := msg.(LobbyAdvert)
+		address := host.Address
+		add(fmt.Sprintf("%s %s %d/%d", advert.Hat, ctx.L.Get(advert.Difficulty), advert.Players, advert.MaxPlayers), func() {
+			s.JoinHost(address)
+		})
+	}
+	for _, lobby := range s.lobbies {
+		lobby := lobby
+		add(lobby, func() {
+			s.lobbyItem.Text = lobby
+			s.JoinHost(lobby)
+		})
+	}
+	s.setHostItems(items)
+}
+
+func (s *Lobby) setHostItems(hostItems []*resources.ButtonItem) {
+	items := s.items[:0]
+	for _, m := range s.items {
+		listed := false
+		for _, l := range s.hostItems {
+			if m == l {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			items = append(items, m)
+		}
+	}
+	for _, l := range hostItems {
+		items = append(items, l)
+	}
+	s.items = items
+	s.hostItems = hostItems
+}
+
+// canConfigure returns whether we decide the game's settings.
+func (s *Lobby) canConfigure() bool {
+	return !s.net.Running || s.net.Hosting
+}
+
+// ShiftDifficulty moves the difficulty up or down by dir.
+func (s *Lobby) ShiftDifficulty(dir int) {
+	if !s.canConfigure() {
+		return
+	}
+	i := 1
+	for j, d := range lobbyDifficulties {
+		if d == s.config.Difficulty {
+			i = j
+		}
+	}
+	i += dir
+	if i < 0 {
+		i = 0
+	} else if i >= len(lobbyDifficulties) {
+		i = len(lobbyDifficulties) - 1
+	}
+	if lobbyDifficulties[i] == s.config.Difficulty {
+		return
+	}
+	s.config.Difficulty = lobbyDifficulties[i]
+	s.configChanged()
+}
+
+// ToggleHints turns hints on or off.
+func (s *Lobby) ToggleHints() {
+	if !s.canConfigure() {
+		return
+	}
+	s.config.ShowHints = !s.config.ShowHints
+	s.configChanged()
+}
+
+// configChanged lets everyone know about the host's new settings.
+func (s *Lobby) configChanged() {
+	s.unready()
+	if !s.net.Running {
+		return
+	}
+	for _, p := range s.net.Peers() {
+		p.Send(s.config)
+	}
+	s.SyncRoster()
+}
+
+// ApplyConfig is used by a joiner to take on the host's settings.
+func (s *Lobby) ApplyConfig(msg LobbyConfigMessage) {
+	if msg == s.config {
+		return
+	}
+	s.config = msg
+	s.unready()
+	s.SyncRoster()
+}
+
+// syncSettings shows the current settings, along with whether each player is ready when networked.
+func (s *Lobby) syncSettings(ctx states.Context) {
+	if s.config.ShowHints {
+		s.hintsItem.Text = ctx.L.Get("Hints on")
+	} else {
+		s.hintsItem.Text = ctx.L.Get("Hints off")
+	}
+	for _, e := range s.playerEntries {
+		e.SyncDifficulty(ctx, s.config.Difficulty, !s.canConfigure())
+		e.SyncReady(ctx, s.net.Running)
+	}
+}
+
+// ToggleReady readies or unreadies one of our players in networked play.
+func (s *Lobby) ToggleReady(e *PlayerEntry) {
+	if _, ok := e.player.(*game.LocalPlayer); !ok || e.pending || s.net.Spectating {
+		return
+	}
+	e.ready = !e.ready
+	s.SyncRoster()
+}
+
+func (s *Lobby) unready() {
+	for _, e := range s.playerEntries {
+		e.ready = false
+	}
+}
+
+// AllReady returns whether every player is ready.
+func (s *Lobby) AllReady() bool {
+	if s.lostPeer != nil || s.PlayerCount() == 0 {
+		return false
+	}
+	for _, e := range s.playerEntries {
+		if e.player != nil && (e.pending || !e.ready) {
+			return false
+		}
+	}
+	for _, p := range s.net.Peers() {
+		if !p.Spectator() && !p.Rejected() && s.GetNetPlayer(p) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// updateCountdown counts down to the start of a networked game.
+func (s *Lobby) updateCountdown(ctx states.Context) {
+	if !s.net.Running {
+		return
+	}
+	if s.net.Hosting {
+		ready := s.AllReady()
+		if ready && s.countdown == 0 {
+			s.countdown = LobbyCountdown * ebiten.TPS()
+			s.sendStart(uint8(LobbyCountdown), false)
+		} else if !ready && s.countdown > 0 {
+			s.countdown = 0
+			s.statusItem.Text = ""
+			s.sendStart(0, false)
+		}
+	}
+	if s.countdown == 0 {
+		return
+	}
+	// Joiners hold at the last tick until the host's word arrives.
+	if s.net.Hosting || s.countdown > 1 {
+		s.countdown--
+	}
+	if s.countdown == 0 {
+		s.sendStart(0, true)
+		s.shouldStart = true
+		return
+	}
+	s.statusItem.Text = fmt.Sprintf("%s %d", ctx.L.Get("Starting in"), (s.countdown+ebiten.TPS()-1)/ebiten.TPS())
+}
+
+func (s *Lobby) sendStart(countdown uint8, begin bool) {
+	for _, p := range s.net.Peers() {
+		p.Send(StartMessage{InputDelay: uint8(game.NetInputDelay), Countdown: countdown, Begin: begin})
+	}
 }
@@ -4,27 +4,151 @@ import (
 	"encoding/binary"
 
 	"github.com/ketMix/retromancer/net"
+	"github.com/ketMix/retromancer/states"
 )
 
-type HatMessage struct {
-	Hat int
+// LocalPlayer is one of the players on a joiner's computer.
+type LocalPlayer struct {
+	Hat   int
+	Ready bool
 }
 
-func (m HatMessage) Ident() uint8 {
-	return 10
+// LocalPlayersMessage is sent by a joiner to tell the host about its players.
+type LocalPlayersMessage struct {
+	Players []LocalPlayer
 }
 
-func (m HatMessage) ToBytes() (b []byte) {
+func (m LocalPlayersMessage) Ident() uint8 {
+	return 12
+}
+
+func (m LocalPlayersMessage) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = append(b, uint8(len(m.Players)))
+	for _, player := range m.Players {
+		b = binary.LittleEndian.AppendUint16(b, uint16(player.Hat))
+		b = appendBool(b, player.Ready)
+	}
+	return
+}
+
+func (m LocalPlayersMessage) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 2 {
+		return nil, 0, net.ErrShortMessage
+	}
+	count := int(b[1])
+	if len(b) < 2+count*3 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset := 2
+	for i := 0; i < count; i++ {
+		m.Players = append(m.Players, LocalPlayer{
+			Hat:   int(binary.LittleEndian.Uint16(b[offset:])),
+			Ready: b[offset+2] != 0,
+		})
+		offset += 3
+	}
+	return m, offset, nil
+}
+
+// RosterSlot is a single player in the roster.
+type RosterSlot struct {
+	Owner uint32
+	Index uint8
+	Hat   int
+	Ready bool
+}
+
+// RosterMessage is sent by the host to everyone whenever the players change.
+type RosterMessage struct {
+	Slots []RosterSlot
+}
+
+func (m RosterMessage) Ident() uint8 {
+	return 13
+}
+
+func (m RosterMessage) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = append(b, uint8(len(m.Slots)))
+	for _, slot := range m.Slots {
+		b = binary.LittleEndian.AppendUint32(b, slot.Owner)
+		b = append(b, slot.Index)
+		b = binary.LittleEndian.AppendUint16(b, uint16(slot.Hat))
+		b = appendBool(b, slot.Ready)
+	}
+	return
+}
+
+func (m RosterMessage) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 2 {
+		return nil, 0, net.ErrShortMessage
+	}
+	count := int(b[1])
+	if len(b) < 2+count*8 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset := 2
+	for i := 0; i < count; i++ {
+		m.Slots = append(m.Slots, RosterSlot{
+			Owner: binary.LittleEndian.Uint32(b[offset:]),
+			Index: b[offset+4],
+			Hat:   int(binary.LittleEndian.Uint16(b[offset+5:])),
+			Ready: b[offset+7] != 0,
+		})
+		offset += 8
+	}
+	return m, offset, nil
+}
+
+// LobbyConfigMessage is sent by the host whenever the game's settings change.
+type LobbyConfigMessage struct {
+	Difficulty  states.Difficulty
+	StartingMap string
+	ShowHints   bool
+	Seed        int64
+}
+
+func (m LobbyConfigMessage) Ident() uint8 {
+	return 15
+}
+
+func (m LobbyConfigMessage) ToBytes() (b []byte) {
 	b = append(b, m.Ident())
-	b = binary.LittleEndian.AppendUint64(b, uint64(m.Hat))
+	b = net.AppendString(b, string(m.Difficulty))
+	b = net.AppendString(b, m.StartingMap)
+	b = appendBool(b, m.ShowHints)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.Seed))
 	return
 }
 
-func (m HatMessage) FromBytes(b []byte) (net.Message, int) {
-	return HatMessage{Hat: int(binary.LittleEndian.Uint64(b[1:]))}, 9
+func (m LobbyConfigMessage) FromBytes(b []byte) (net.Message, int, error) {
+	offset := 1
+	difficulty, n := net.ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+	startingMap, n := net.ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+	if len(b) < offset+9 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Difficulty = states.Difficulty(difficulty)
+	m.StartingMap = startingMap
+	m.ShowHints = b[offset] != 0
+	m.Seed = int64(binary.LittleEndian.Uint64(b[offset+1:]))
+	return m, offset + 9, nil
 }
 
+// StartMessage is sent by the host to count down to the start of the game, or to begin it.
 type StartMessage struct {
+	InputDelay uint8
+	Countdown  uint8 // Seconds until the game starts. 0 stops the countdown.
+	Begin      bool  // Set once the countdown is over, to start the game.
 }
 
 func (m StartMessage) Ident() uint8 {
@@ -33,9 +157,69 @@ func (m StartMessage) Ident() uint8 {
 
 func (m StartMessage) ToBytes() (b []byte) {
 	b = append(b, m.Ident())
+	b = append(b, m.InputDelay, m.Countdown)
+	b = appendBool(b, m.Begin)
+	return
+}
+
+func (m StartMessage) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 4 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.InputDelay = b[1]
+	m.Countdown = b[2]
+	m.Begin = b[3] != 0
+	return m, 4, nil
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// LobbyAdvert is what a host broadcasts about its lobby to the LAN.
+type LobbyAdvert struct {
+	Hat        string
+	Difficulty string
+	Players    uint8
+	MaxPlayers uint8
+}
+
+func (m LobbyAdvert) Ident() uint8 {
+	return 14
+}
+
+func (m LobbyAdvert) ToBytes() (b []byte) {
+	b = append(b, m.Ident())
+	b = net.AppendString(b, m.Hat)
+	b = net.AppendString(b, m.Difficulty)
+	b = append(b, m.Players, m.MaxPlayers)
 	return
 }
 
-func (m StartMessage) FromBytes(b []byte) (net.Message, int) {
-	return m, 1
+func (m LobbyAdvert) FromBytes(b []byte) (net.Message, int, error) {
+	if len(b) < 1 || b[0] != m.Ident() {
+		return nil, 0, net.ErrUnexpectedMessage
+	}
+	offset := 1
+	hat, n := net.ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+	difficulty, n := net.ReadString(b[offset:])
+	if n < 0 {
+		return nil, 0, net.ErrShortMessage
+	}
+	offset += n
+	if len(b) < offset+2 {
+		return nil, 0, net.ErrShortMessage
+	}
+	m.Hat = hat
+	m.Difficulty = difficulty
+	m.Players = b[offset]
+	m.MaxPlayers = b[offset+1]
+	return m, offset + 2, nil
 }
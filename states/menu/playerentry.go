@@ -35,19 +35,20 @@ type PlayerEntry struct {
 	controllerIndex  int
 	useController    bool
 	//
-	difficulties []states.Difficulty
-	diffIndex    int
-	diffTitle    *resources.TextItem
-	diffLeft     *resources.SpriteItem
-	diffRight    *resources.SpriteItem
-	diffItem     *resources.TextItem
+	diffTitle *resources.TextItem
+	diffLeft  *resources.SpriteItem
+	diffRight *resources.SpriteItem
+	diffItem  *resources.TextItem
 	//
 	startText *resources.TextItem
 	//
 	waitingText *resources.TextItem
 	//
-	id     uint32 // ID. Only set if it is a networked player.
-	player game.Player
+	id      uint32 // ID. Only set if it is a networked player.
+	index   int    // Which of its computer's players this is.
+	pending bool   // Set for our players that the host has yet to put in the roster.
+	ready   bool   // Set once the player is ready to start a networked game.
+	player  game.Player
 }
 
 func (e *PlayerEntry) SetPlayer(player game.Player) {
@@ -81,8 +82,34 @@ func (e *PlayerEntry) SyncController(ctx states.Context) {
 	}
 }
 
-func (e *PlayerEntry) SyncDifficulty(ctx states.Context, i int) {
-	e.diffItem.Text = ctx.L.Get(string(e.difficulties[i]))
+// SetRemote makes the entry show a networked player, which we have no control over.
+func (e *PlayerEntry) SetRemote(ctx states.Context, player *game.RemotePlayer) {
+	e.player = player
+	e.hatLeft.SetHidden(true)
+	e.hatRight.SetHidden(true)
+	e.controllerLeft.SetHidden(true)
+	e.controllerRight.SetHidden(true)
+	e.controllerItem.Sprite = resources.NewSprite(ctx.R.Get("images", "network").(*ebiten.Image))
+	e.controllerItem.Sprite.Centered = true
+	e.waitingText.SetHidden(true)
+}
+
+// SyncDifficulty shows the lobby's difficulty. Locked hides the controls for changing it.
+func (e *PlayerEntry) SyncDifficulty(ctx states.Context, difficulty states.Difficulty, locked bool) {
+	e.diffItem.Text = ctx.L.Get(string(difficulty))
+	e.diffLeft.SetHidden(locked)
+	e.diffRight.SetHidden(locked)
+}
+
+// SyncReady shows whether the player is ready in networked play, or the start button otherwise.
+func (e *PlayerEntry) SyncReady(ctx states.Context, networked bool) {
+	if !networked {
+		e.startText.Text = ctx.L.Get("Start")
+	} else if e.ready {
+		e.startText.Text = ctx.L.Get("Ready")
+	} else {
+		e.startText.Text = ctx.L.Get("Not ready")
+	}
 }
 
 func (e *PlayerEntry) SetController(dir int) {
@@ -137,7 +164,7 @@ func (e *PlayerEntry) Init(s *Lobby, ctx states.Context) error {
 			}
 			e.clickSound.Play(1.0)
 			e.SyncHat(ctx)
-			s.SendToNetPlayers(HatMessage{Hat: e.hatIndex})
+			s.SyncRoster()
 			return false
 		},
 	}
@@ -161,7 +188,7 @@ func (e *PlayerEntry) Init(s *Lobby, ctx states.Context) error {
 			}
 			e.clickSound.Play(1.0)
 			e.SyncHat(ctx)
-			s.SendToNetPlayers(HatMessage{Hat: e.hatIndex})
+			s.SyncRoster()
 			return false
 		},
 	}
@@ -233,9 +260,6 @@ func (e *PlayerEntry) Init(s *Lobby, ctx states.Context) error {
 	}
 
 	// Difficulty
-	e.difficulties = []states.Difficulty{states.DifficultyEasy, states.DifficultyNormal, states.DifficultyHard}
-	e.diffIndex = 1
-
 	e.diffTitle = &resources.TextItem{
 		Text: ctx.L.Get("Difficulty"),
 	}
@@ -243,30 +267,22 @@ func (e *PlayerEntry) Init(s *Lobby, ctx states.Context) error {
 	e.diffLeft = &resources.SpriteItem{
 		Sprite: resources.NewSprite(ctx.R.Get("images", "arrow-left").(*ebiten.Image)),
 		Callback: func() bool {
-			e.diffIndex--
 			e.clickSound.Play(1.0)
-			if e.diffIndex < 0 {
-				e.diffIndex = 0
-			}
-			e.SyncDifficulty(ctx, e.diffIndex)
+			s.ShiftDifficulty(-1)
 			return false
 		},
 	}
 	e.diffLeft.Sprite.Centered = true
 
 	e.diffItem = &resources.TextItem{
-		Text: ctx.L.Get(string(e.difficulties[e.diffIndex])),
+		Text: ctx.L.Get(string(s.config.Difficulty)),
 	}
 
 	e.diffRight = &resources.SpriteItem{
 		Sprite: resources.NewSprite(ctx.R.Get("images", "arrow-right").(*ebiten.Image)),
 		Callback: func() bool {
-			e.diffIndex++
 			e.clickSound.Play(1.0)
-			if e.diffIndex > len(e.difficulties)-1 {
-				e.diffIndex = len(e.difficulties) - 1
-			}
-			e.SyncDifficulty(ctx, e.diffIndex)
+			s.ShiftDifficulty(1)
 			return false
 		},
 	}
@@ -284,9 +300,11 @@ func (e *PlayerEntry) Init(s *Lobby, ctx states.Context) error {
 		Text: ctx.L.Get("Start"),
 		Callback: func() bool {
 			e.clickSound.Play(1.0)
-			if !s.net.Running || s.net.Hosting {
+			// Networked games start once everyone is ready.
+			if s.net.Running {
+				s.ToggleReady(e)
+			} else {
 				s.shouldStart = true
-				s.difficulty = e.difficulties[e.diffIndex]
 			}
 			return false
 		},
@@ -0,0 +1,119 @@
+// Package statestest provides stand-ins for what a states.Context holds.
+package statestest
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/ketMix/retromancer/resources"
+	"github.com/ketMix/retromancer/states"
+)
+
+// Resources holds resources by category and name, falling back like the game's resource manager.
+type Resources struct {
+	Fallback *ebiten.Image // Returned for missing images.
+	data     map[string]map[string]interface{}
+}
+
+// NewResources returns an empty set of resources, with a blank image for any that are missing.
+func NewResources() *Resources {
+	return &Resources{
+		Fallback: ebiten.NewImage(16, 16),
+		data:     make(map[string]map[string]interface{}),
+	}
+}
+
+// Add adds a resource under the given category and name.
+func (r *Resources) Add(category, name string, v interface{}) {
+	if r.data[category] == nil {
+		r.data[category] = make(map[string]interface{})
+	}
+	r.data[category][name] = v
+}
+
+func (r *Resources) Get(category string, name string) interface{} {
+	if v, ok := r.data[category][name]; ok {
+		return v
+	}
+	return nil
+}
+
+func (r *Resources) GetAs(category string, name string, target interface{}) interface{} {
+	if v := r.Get(category, name); v != nil {
+		return v
+	}
+	switch target.(type) {
+	case *ebiten.Image:
+		return r.Fallback
+	case *resources.Map:
+		return &resources.Map{}
+	case *resources.BulletGroup:
+		return &resources.BulletGroup{}
+	case *resources.Enemy:
+		return &resources.Enemy{}
+	case *resources.Sound:
+		return &resources.Sound{}
+	}
+	return target
+}
+
+func (r *Resources) GetNamesWithPrefix(category string, prefix string) []string {
+	var names []string
+	for name := range r.data[category] {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Localizer returns keys as they are.
+type Localizer struct{}
+
+func (Localizer) SetGPTStyle(style string)       {}
+func (Localizer) GetGPTStyle() string            { return "" }
+func (Localizer) SetGPTKey(key string)           {}
+func (Localizer) GetGPTKey() string              { return "" }
+func (Localizer) CheckGPTKey() bool              { return false }
+func (Localizer) GPTIsActive() bool              { return false }
+func (Localizer) InitGPT()                       {}
+func (Localizer) Locale() string                 { return "en" }
+func (Localizer) SetLocale(loc string, gpt bool) {}
+func (Localizer) Get(key string) string          { return key }
+
+type Cursor struct{}
+
+func (Cursor) Enabled() bool { return true }
+func (Cursor) Enable()       {}
+func (Cursor) Disable()      {}
+
+// MusicPlayer plays nothing.
+type MusicPlayer struct{}
+
+func (MusicPlayer) Play(s states.Song) error { return nil }
+func (MusicPlayer) Resume()                  {}
+func (MusicPlayer) Pause()                   {}
+func (MusicPlayer) Loop() bool               { return false }
+func (MusicPlayer) SetLoop(loop bool)        {}
+func (MusicPlayer) Volume() float64          { return 1 }
+func (MusicPlayer) SetVolume(volume float64) {}
+
+// StateMachine ignores any states pushed or popped.
+type StateMachine struct{}
+
+func (StateMachine) PushState(state states.State) {}
+func (StateMachine) PopState(v interface{})       {}
+
+// Context returns a context on normal difficulty using the given resources.
+func Context(r *Resources) states.Context {
+	return states.Context{
+		StateMachine: StateMachine{},
+		Cursor:       Cursor{},
+		MusicPlayer:  MusicPlayer{},
+		Difficulty:   states.DifficultyNormal,
+		R:            r,
+		L:            Localizer{},
+	}
+}